@@ -8,44 +8,97 @@
 package fastio
 
 import (
+	"errors"
+	"io"
 	"os"
+	"sync/atomic"
+	"time"
 )
 
+var ErrClosed = errors.New("fastio: file is closed")
+
 type File interface {
 	Write([]byte) (int, error)
 	WriteAt([]byte, int64) (int, error)
 	WriteSync([]byte) (int64, error)
+	// WriteV writes the pieces contiguously as one record and returns its offset
+	WriteV([][]byte) (int64, error)
+	// WriteVBatch writes the records contiguously and returns the offset of each record
+	WriteVBatch([][][]byte) ([]int64, error)
 	ReadAt([]byte, int64) (int, error)
 	Read([]byte) (int, error)
+	// Sync writes the pending data and commits the file to stable storage
+	Sync() error
+	// Size returns the size of the file including the pending data
+	Size() (int64, error)
+	// Truncate changes the size of the file, later appends continue at size
+	Truncate(size int64) error
+	// Close writes the pending data and closes the file, later calls return ErrClosed
 	Close() error
 }
 
+// SyncMode determines whether WriteSync waits for stable storage
+type SyncMode int
+
+const (
+	// SyncNone returns from WriteSync once the data is written to the file, the default
+	SyncNone SyncMode = iota
+	// SyncGroup returns from WriteSync once the data is on stable storage. Concurrent callers
+	// share one write and one fsync (fdatasync on Linux) per batch.
+	SyncGroup
+)
+
+// Options configures a File
+type Options struct {
+	Sync SyncMode
+	// MaxBatchDelay is how long a batch of SyncGroup waits for more callers before it is written,
+	// zero writes a batch at once; batches written during an fsync still share the next fsync
+	MaxBatchDelay time.Duration
+	// MaxBatchSize is the size in bytes at which a batch of SyncGroup is written without waiting further, zero means no limit
+	MaxBatchSize int
+}
+
 func Open(path string) (r File, err error) {
+	return OpenWithOptions(path, nil)
+}
+
+func OpenWithOptions(path string, opts *Options) (r File, err error) {
 	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0666)
 	if err != nil {
 		return nil, err
 	}
-	return New(f)
+	return NewWithOptions(f, opts)
 }
 
 func New(f *os.File) (r File, err error) {
+	return NewWithOptions(f, nil)
+}
+
+func NewWithOptions(f *os.File, opts *Options) (r File, err error) {
 	ret, err := offset(f)
 	if err != nil {
 		return nil, err
 	}
 	fh := &fileHandle{file: f, offset: ret}
-	fh.writer = newWriter(fh)
+	fh.writer = newWriter(fh, opts)
 	return fh, nil
 }
 
 type fileHandle struct {
-	offset  int64
-	file    *os.File
-	isClose bool
-	writer  writer
+	offset int64
+	file   *os.File
+	closed int32
+	writer writer
+}
+
+func (f *fileHandle) isClosed() bool {
+	return atomic.LoadInt32(&f.closed) == 1
 }
 
 func (f *fileHandle) WriteAt(b []byte, off int64) (n int, err error) {
+	if f.isClosed() {
+		return 0, ErrClosed
+	}
 	return f.file.WriteAt(b, off)
 }
 
@@ -53,19 +106,70 @@ func (f *fileHandle) WriteSync(b []byte) (offset int64, err error) {
 	return f.writer.WriteSync(b)
 }
 
+func (f *fileHandle) WriteV(bufs [][]byte) (offset int64, err error) {
+	return f.writer.WriteV(bufs)
+}
+
+func (f *fileHandle) WriteVBatch(records [][][]byte) (offsets []int64, err error) {
+	return f.writer.WriteVBatch(records)
+}
+
 func (f *fileHandle) Write(b []byte) (n int, err error) {
 	return f.writer.Write(b)
 }
 
 func (f *fileHandle) ReadAt(b []byte, off int64) (n int, err error) {
+	if f.isClosed() {
+		return 0, ErrClosed
+	}
 	return f.file.ReadAt(b, off)
 }
 
 func (f *fileHandle) Read(b []byte) (n int, err error) {
+	if f.isClosed() {
+		return 0, ErrClosed
+	}
 	return f.file.Read(b)
 }
 
+func (f *fileHandle) Sync() error {
+	return f.writer.exclusive(f.file.Sync)
+}
+
+func (f *fileHandle) Size() (size int64, err error) {
+	err = f.writer.exclusive(func() error {
+		fi, err := f.file.Stat()
+		if err == nil {
+			size = fi.Size()
+		}
+		return err
+	})
+	return
+}
+
+func (f *fileHandle) Truncate(size int64) error {
+	return f.writer.exclusive(func() (err error) {
+		if err = f.file.Truncate(size); err != nil {
+			return
+		}
+		if _, err = f.file.Seek(size, io.SeekStart); err != nil {
+			return
+		}
+		atomic.StoreInt64(&f.offset, size)
+		if m := f.writer.(*mwriter); m.group != nil {
+			m.group.truncated(size)
+		}
+		return
+	})
+}
+
 func (f *fileHandle) Close() (err error) {
-	f.isClose = true
-	return f.file.Close()
+	if !atomic.CompareAndSwapInt32(&f.closed, 0, 1) {
+		return ErrClosed
+	}
+	err = f.writer.close()
+	if e := f.file.Close(); err == nil {
+		err = e
+	}
+	return
 }
@@ -0,0 +1,235 @@
+// Copyright (c) 2023, donnie <donnie4w@gmail.com>
+// All rights reserved.
+// Use of t source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// github.com/donnie4w/gofer/fastio
+
+package fastio
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// pieces returns a record of n small pieces and its concatenation
+func pieces(id, n int) (bufs [][]byte, rec []byte) {
+	for i := 0; i < n; i++ {
+		b := bytes.Repeat([]byte{byte('a' + id%26)}, 1+i%3)
+		bufs = append(bufs, b)
+		rec = append(rec, b...)
+	}
+	return
+}
+
+func TestWriteV(t *testing.T) {
+	for _, opts := range []*Options{nil, {Sync: SyncGroup}} {
+		path := filepath.Join(t.TempDir(), "writev")
+		f, err := OpenWithOptions(path, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		recs := make([][]byte, 8)
+		offs := make([]int64, 8)
+		var wg sync.WaitGroup
+		for g := range recs {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				// more pieces than one writev call accepts
+				bufs, rec := pieces(g, 3000)
+				f.Write([]byte("|"))
+				off, err := f.WriteV(bufs)
+				if err != nil {
+					t.Error(err)
+				}
+				recs[g], offs[g] = rec, off
+			}(g)
+		}
+		wg.Wait()
+		if err = f.Close(); err != nil {
+			t.Fatal(err)
+		}
+		bs, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(bs) != 8*(len(recs[0])+1) {
+			t.Fatalf("file has %d bytes", len(bs))
+		}
+		for g, rec := range recs {
+			if !bytes.Equal(bs[offs[g]:offs[g]+int64(len(rec))], rec) {
+				t.Fatalf("record %d is not contiguous at %d", g, offs[g])
+			}
+		}
+	}
+}
+
+func TestWriteVBatch(t *testing.T) {
+	for _, opts := range []*Options{nil, {Sync: SyncGroup}} {
+		path := filepath.Join(t.TempDir(), "writev")
+		f, err := OpenWithOptions(path, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte("head"))
+		var records [][][]byte
+		var recs [][]byte
+		for i := 0; i < 5; i++ {
+			bufs, rec := pieces(i, 500*i)
+			records, recs = append(records, bufs), append(recs, rec)
+		}
+		offs, err := f.WriteVBatch(records)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		bs, _ := os.ReadFile(path)
+		off := int64(4)
+		for i, rec := range recs {
+			if offs[i] != off || !bytes.Equal(bs[off:off+int64(len(rec))], rec) {
+				t.Fatalf("record %d at %d, expected %d", i, offs[i], off)
+			}
+			off += int64(len(rec))
+		}
+		if off != int64(len(bs)) {
+			t.Fatalf("file has %d bytes, expected %d", len(bs), off)
+		}
+	}
+}
+
+// writeConcurrently writes n records of size bytes from 8 goroutines with Write, which does not wait
+func writeConcurrently(f File, n, size int) {
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < n/8; i++ {
+				f.Write(make([]byte, size))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestCloseDrains(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "close")
+	f, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeConcurrently(f, 8000, 100)
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Size() != 800000 {
+		t.Fatalf("queued writes lost after Close: %v %v", fi.Size(), err)
+	}
+}
+
+func TestSizeIncludesPending(t *testing.T) {
+	f, err := Open(filepath.Join(t.TempDir(), "size"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	writeConcurrently(f, 8000, 100)
+	if size, err := f.Size(); err != nil || size != 800000 {
+		t.Fatalf("Size %d %v", size, err)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	for _, opts := range []*Options{nil, {Sync: SyncGroup}} {
+		path := filepath.Join(t.TempDir(), "truncate")
+		f, err := OpenWithOptions(path, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write(bytes.Repeat([]byte("x"), 100))
+		if err = f.Truncate(10); err != nil {
+			t.Fatal(err)
+		}
+		if off, err := f.WriteSync([]byte("abc")); err != nil || off != 10 {
+			t.Fatalf("append after Truncate at %d %v", off, err)
+		}
+		if off, err := f.WriteV([][]byte{[]byte("de"), []byte("f")}); err != nil || off != 13 {
+			t.Fatalf("append after Truncate at %d %v", off, err)
+		}
+		if size, err := f.Size(); err != nil || size != 16 {
+			t.Fatalf("Size %d %v", size, err)
+		}
+		f.Close()
+		if bs, _ := os.ReadFile(path); string(bs) != "xxxxxxxxxxabcdef" {
+			t.Fatalf("unexpected content %q", bs)
+		}
+	}
+}
+
+func TestClosed(t *testing.T) {
+	f, err := Open(filepath.Join(t.TempDir(), "closed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b := []byte("x")
+	errs := map[string]error{}
+	_, errs["Write"] = f.Write(b)
+	_, errs["WriteAt"] = f.WriteAt(b, 0)
+	_, errs["WriteSync"] = f.WriteSync(b)
+	_, errs["WriteV"] = f.WriteV([][]byte{b})
+	_, errs["WriteVBatch"] = f.WriteVBatch([][][]byte{{b}})
+	_, errs["ReadAt"] = f.ReadAt(b, 0)
+	_, errs["Read"] = f.Read(b)
+	errs["Sync"] = f.Sync()
+	_, errs["Size"] = f.Size()
+	errs["Truncate"] = f.Truncate(0)
+	errs["Close"] = f.Close()
+	for name, err := range errs {
+		if err != ErrClosed {
+			t.Errorf("%s after Close: %v", name, err)
+		}
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "readonly")
+	if err := os.WriteFile(path, nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	ro, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := New(ro)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	// no other writer is running, the error is returned by Write itself
+	if n, err := f.Write([]byte("hello")); n != 0 || err == nil {
+		t.Fatalf("Write to a read-only file: %d %v", n, err)
+	}
+	// a write queued behind a flusher reports its error once, on the next call
+	var queued error
+	f.(*fileHandle).writer.exclusive(func() error {
+		_, queued = f.Write([]byte("queued"))
+		return nil
+	})
+	if queued != nil {
+		t.Fatalf("queued Write: %v", queued)
+	}
+	// an empty write does not touch the file
+	if _, err = f.Write(nil); err == nil {
+		t.Fatal("error of the queued Write not reported")
+	}
+	if _, err = f.Write(nil); err != nil {
+		t.Fatalf("error of the queued Write reported twice: %v", err)
+	}
+}
@@ -8,120 +8,233 @@
 package fastio
 
 import (
-	"bufio"
 	"sync"
 	"sync/atomic"
-	"time"
 )
 
 type writer interface {
 	WriteSync(bs []byte) (offset int64, err error)
 	Write(bs []byte) (n int, err error)
+	WriteV(bufs [][]byte) (offset int64, err error)
+	WriteVBatch(records [][][]byte) (offsets []int64, err error)
+	// exclusive runs f while no write is in progress
+	exclusive(f func() error) error
+	// close writes the pending data and rejects later writes
+	close() error
 }
 
 type writeData struct {
-	data   []byte
-	offset int64
-	done   chan struct{}
+	bufs    [][]byte
+	offset  int64
+	written int64 // bytes of bufs written
+	err     error
+	done    chan struct{} // nil for Write, which does not wait
+	flusher bool          // written by its caller, which reports the error itself
 }
 
+// mwriter batches concurrent writes: the caller that finds no write in progress becomes the
+// flusher and writes everything queued meanwhile with one writev, until the queue is empty
 type mwriter struct {
-	ch    chan *writeData
-	mu    sync.RWMutex
-	wc    int32
-	cc    int32
-	fh    *fileHandle
-	ioend bool
+	fh       *fileHandle
+	mux      sync.Mutex
+	cond     *sync.Cond // signalled when flushing ends
+	queue    []*writeData
+	spare    []*writeData
+	flushing bool
+	closed   bool
+	err      atomic.Pointer[error] // error of a queued Write that was not reported yet
+	group    *groupCommit
 }
 
-func newWriter(fh *fileHandle) writer {
-	return &mwriter{fh: fh, ch: make(chan *writeData, 1<<16), ioend: true}
+func newWriter(fh *fileHandle, opts *Options) writer {
+	m := &mwriter{fh: fh}
+	m.cond = sync.NewCond(&m.mux)
+	if opts != nil && opts.Sync == SyncGroup {
+		m.group = newGroupCommit(m, opts.MaxBatchDelay, opts.MaxBatchSize)
+	}
+	return m
 }
 
-func (m *mwriter) WriteSync(bs []byte) (offset int64, err error) {
-	defer atomic.AddInt32(&m.cc, -1)
-	if atomic.AddInt32(&m.cc, 1) <= 1 {
-		m.mu.Lock()
-		defer m.mu.Unlock()
-		if m.wc > 0 {
-			m.ioWrite()
-		}
-		n := 0
-		n, err = m.fh.file.Write(bs)
-		offset = m.fh.offset
-		atomic.AddInt64(&m.fh.offset, int64(n))
-		return
+// submit queues wd and writes the queue if no other caller does, flushed reports whether
+// wd was written before submit returned
+func (m *mwriter) submit(wd *writeData) (flushed bool, err error) {
+	m.mux.Lock()
+	if m.closed {
+		m.mux.Unlock()
+		return false, ErrClosed
 	}
-	atomic.AddInt32(&m.wc, 1)
-	wd := &writeData{data: bs, done: make(chan struct{})}
-	m.ch <- wd
-START:
-	if m.ioend && m.mu.TryLock() {
-		if err = m.ioWrite(); err != nil {
+	m.queue = append(m.queue, wd)
+	if m.flushing {
+		m.mux.Unlock()
+		return false, nil
+	}
+	m.flushing, wd.flusher = true, true
+	m.mux.Unlock()
+	m.drain()
+	return true, nil
+}
+
+// drain writes the queue until it is empty, the caller must have set flushing
+func (m *mwriter) drain() {
+	for {
+		m.mux.Lock()
+		q := m.queue
+		if len(q) == 0 {
+			m.flushing = false
+			m.cond.Broadcast()
+			m.mux.Unlock()
 			return
 		}
-		m.mu.Unlock()
+		m.queue, m.spare = m.spare[:0], nil
+		m.mux.Unlock()
+		m.writeBatch(q)
+		clear(q)
+		m.mux.Lock()
+		m.spare = q
+		m.mux.Unlock()
+	}
+}
+
+func (m *mwriter) writeBatch(q []*writeData) {
+	var bufs [][]byte
+	if len(q) == 1 {
+		bufs = q[0].bufs
 	} else {
-		select {
-		case <-wd.done:
-			goto END
-		case <-time.After(time.Microsecond):
-			goto START
+		for _, wd := range q {
+			bufs = append(bufs, wd.bufs...)
 		}
 	}
-END:
-	offset = wd.offset
-	return
+	base := atomic.LoadInt64(&m.fh.offset)
+	n, err := writev(m.fh.file, bufs)
+	atomic.AddInt64(&m.fh.offset, n)
+	offset := base
+	for _, wd := range q {
+		wd.offset = offset
+		for _, b := range wd.bufs {
+			offset += int64(len(b))
+		}
+		wd.written = min(max(base+n-wd.offset, 0), offset-wd.offset)
+		if offset > base+n {
+			wd.err = err
+			if wd.done == nil && !wd.flusher {
+				// the caller of Write returned already
+				m.err.CompareAndSwap(nil, &err)
+			}
+		}
+		if wd.done != nil {
+			close(wd.done)
+		}
+	}
+}
+
+// failed returns the error of a queued Write and clears it, so that it is reported once
+func (m *mwriter) failed() error {
+	if p := m.err.Swap(nil); p != nil {
+		return *p
+	}
+	return nil
+}
+
+func (m *mwriter) WriteSync(bs []byte) (offset int64, err error) {
+	if m.group != nil {
+		return m.group.writeSync(bs)
+	}
+	return m.writeSync([][]byte{bs})
+}
+
+// writeSync writes bufs contiguously and returns after they are written
+func (m *mwriter) writeSync(bufs [][]byte) (offset int64, err error) {
+	wd := &writeData{bufs: bufs, done: make(chan struct{})}
+	if _, err = m.submit(wd); err != nil {
+		return
+	}
+	<-wd.done
+	return wd.offset, wd.err
 }
 
+// Write queues bs and returns without waiting if another caller is writing, otherwise it writes
+// bs and the queue and returns its own error. The error of a queued write is returned once, by the
+// next Write or by Close.
 func (m *mwriter) Write(bs []byte) (n int, err error) {
-	defer atomic.AddInt32(&m.cc, -1)
-	if atomic.AddInt32(&m.cc, 1) <= 1 {
-		m.mu.RLock()
-		defer m.mu.RUnlock()
-		if m.wc > 0 {
-			m.ioWrite()
-		}
-		if n, err = m.fh.file.Write(bs); n > 0 {
-			atomic.AddInt64(&m.fh.offset, int64(n))
-		}
-		return n, err
+	if err = m.failed(); err != nil {
+		return
 	}
-	atomic.AddInt32(&m.wc, 1)
-	m.ch <- &writeData{data: bs}
-START:
-	if m.ioend && m.mu.TryLock() {
-		if err = m.ioWrite(); err != nil {
-			return
-		}
-		m.mu.Unlock()
-	} else if m.ioend {
-		goto START
+	wd := &writeData{bufs: [][]byte{bs}}
+	flushed, err := m.submit(wd)
+	if err != nil {
+		return
+	}
+	if flushed {
+		return int(wd.written), wd.err
 	}
 	return len(bs), nil
 }
 
-func (m *mwriter) ioWrite() (err error) {
-	if m.wc == 0 {
-		return
+func (m *mwriter) WriteV(bufs [][]byte) (offset int64, err error) {
+	offsets, err := m.WriteVBatch([][][]byte{bufs})
+	if err != nil {
+		return 0, err
 	}
-	m.ioend = false
-	defer recoverable(&err)
-	bw := bufio.NewWriter(m.fh.file)
-	for wd := range m.ch {
-		if wd.done != nil {
-			defer func() { close(wd.done) }()
-		}
-		wd.offset = m.fh.offset
-		if _, err = bw.Write(wd.data); err != nil {
-			return
+	return offsets[0], nil
+}
+
+func (m *mwriter) WriteVBatch(records [][][]byte) (offsets []int64, err error) {
+	var bufs [][]byte
+	offsets = make([]int64, len(records))
+	var size int64
+	for i, r := range records {
+		offsets[i] = size
+		for _, b := range r {
+			size += int64(len(b))
 		}
-		atomic.AddInt64(&m.fh.offset, int64(len(wd.data)))
-		if atomic.AddInt32(&m.wc, -1) == 0 {
-			break
+		bufs = append(bufs, r...)
+	}
+	var base int64
+	if m.group != nil {
+		buf := make([]byte, 0, size)
+		for _, b := range bufs {
+			buf = append(buf, b...)
 		}
+		base, err = m.group.writeSync(buf)
+	} else {
+		base, err = m.writeSync(bufs)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i := range offsets {
+		offsets[i] += base
 	}
-	m.ioend = true
-	err = bw.Flush()
 	return
 }
+
+func (m *mwriter) exclusive(f func() error) error {
+	m.mux.Lock()
+	for m.flushing {
+		m.cond.Wait()
+	}
+	if m.closed {
+		m.mux.Unlock()
+		return ErrClosed
+	}
+	// writers queue meanwhile and the queue is drained afterwards
+	m.flushing = true
+	m.mux.Unlock()
+	err := f()
+	m.drain()
+	return err
+}
+
+func (m *mwriter) close() error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if m.closed {
+		return ErrClosed
+	}
+	m.closed = true
+	// the current flusher writes what was queued before
+	for m.flushing {
+		m.cond.Wait()
+	}
+	return m.failed()
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2023, donnie <donnie4w@gmail.com>
+// All rights reserved.
+// Use of t source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// github.com/donnie4w/gofer/fastio
+
+package fastio
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// syncFile flushes a file to stable storage, tests replace it to count the flushes
+var syncFile = datasync
+
+// groupCommit makes WriteSync durable: concurrent callers are collected into a batch that is
+// written with one write and flushed with one fdatasync
+type groupCommit struct {
+	m      *mwriter
+	delay  time.Duration
+	size   int
+	mux    sync.Mutex
+	cur    *batch // the batch new callers join, guarded by mux
+	smux   sync.Mutex
+	synced int64 // end of the data on stable storage, guarded by smux
+}
+
+type batch struct {
+	data    [][]byte
+	n       int
+	offsets []int64
+	full    chan struct{} // closed when the batch reached the max batch size
+	done    chan struct{}
+	err     error
+}
+
+func newGroupCommit(m *mwriter, delay time.Duration, size int) *groupCommit {
+	return &groupCommit{m: m, delay: delay, size: size}
+}
+
+// writeSync returns after bs and the batch it joined are on stable storage
+func (g *groupCommit) writeSync(bs []byte) (offset int64, err error) {
+	g.mux.Lock()
+	b, leader := g.cur, false
+	if b == nil {
+		b = &batch{full: make(chan struct{}), done: make(chan struct{})}
+		g.cur, leader = b, true
+	}
+	idx := len(b.data)
+	b.data = append(b.data, bs)
+	b.n += len(bs)
+	if g.size > 0 && b.n >= g.size {
+		// later callers start the next batch
+		g.cur = nil
+		close(b.full)
+	}
+	g.mux.Unlock()
+
+	if leader {
+		g.commit(b)
+	}
+	<-b.done
+	if b.err != nil {
+		return 0, b.err
+	}
+	return b.offsets[idx], nil
+}
+
+// commit waits up to the max batch delay for more callers, then writes and flushes the batch
+func (g *groupCommit) commit(b *batch) {
+	defer close(b.done)
+	if g.delay > 0 {
+		timer := time.NewTimer(g.delay)
+		select {
+		case <-timer.C:
+		case <-b.full:
+		}
+		timer.Stop()
+	}
+	g.mux.Lock()
+	if g.cur == b {
+		g.cur = nil
+	}
+	g.mux.Unlock()
+	var offset int64
+	if offset, b.err = g.m.writeSync(b.data); b.err != nil {
+		return
+	}
+	b.offsets = make([]int64, len(b.data))
+	for i, bs := range b.data {
+		b.offsets[i] = offset
+		offset += int64(len(bs))
+	}
+	b.err = g.sync(offset)
+}
+
+// sync makes the file durable up to end; batches written during an fsync share the next one
+func (g *groupCommit) sync(end int64) (err error) {
+	g.smux.Lock()
+	defer g.smux.Unlock()
+	if g.synced >= end {
+		return
+	}
+	written := atomic.LoadInt64(&g.m.fh.offset)
+	if err = syncFile(g.m.fh.file); err == nil {
+		g.synced = written
+	}
+	return
+}
+
+// truncated lowers the synced end after the file was truncated to size
+func (g *groupCommit) truncated(size int64) {
+	g.smux.Lock()
+	g.synced = min(g.synced, size)
+	g.smux.Unlock()
+}
@@ -0,0 +1,115 @@
+// Copyright (c) 2023, donnie <donnie4w@gmail.com>
+// All rights reserved.
+// Use of t source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// github.com/donnie4w/gofer/fastio
+
+package fastio
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGroupCommitSharedSync(t *testing.T) {
+	var syncs, durable int64
+	syncFile = func(f *os.File) error {
+		atomic.AddInt64(&syncs, 1)
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		time.Sleep(20 * time.Millisecond)
+		if err = datasync(f); err == nil {
+			atomic.StoreInt64(&durable, fi.Size())
+		}
+		return err
+	}
+	defer func() { syncFile = datasync }()
+
+	const callers, size = 16, 10
+	// the batch is written once every caller joined it
+	f, err := OpenWithOptions(filepath.Join(t.TempDir(), "group"), &Options{Sync: SyncGroup, MaxBatchSize: callers * size, MaxBatchDelay: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			off, err := f.WriteSync([]byte(fmt.Sprintf("%09d\n", i)))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if d := atomic.LoadInt64(&durable); off+size > d {
+				t.Errorf("WriteSync returned before the fsync: record ends at %d, durable %d", off+size, d)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n := atomic.LoadInt64(&syncs); n != 1 {
+		t.Fatalf("%d fsyncs for one batch", n)
+	}
+}
+
+func TestGroupCommitOffsets(t *testing.T) {
+	for _, opts := range []*Options{
+		{Sync: SyncGroup},
+		{Sync: SyncGroup, MaxBatchDelay: time.Millisecond},
+		{Sync: SyncGroup, MaxBatchDelay: time.Millisecond, MaxBatchSize: 64},
+		{Sync: SyncGroup, MaxBatchDelay: time.Minute, MaxBatchSize: 1},
+	} {
+		path := filepath.Join(t.TempDir(), "group")
+		f, err := OpenWithOptions(path, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var mux sync.Mutex
+		recs := map[int64]string{}
+		var wg sync.WaitGroup
+		for g := 0; g < 8; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				for i := 0; i < 50; i++ {
+					rec := fmt.Sprintf("<%d-%d%s>", g, i, make([]byte, i%7))
+					off, err := f.WriteSync([]byte(rec))
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					mux.Lock()
+					recs[off] = rec
+					mux.Unlock()
+				}
+			}(g)
+		}
+		wg.Wait()
+		if err = f.Close(); err != nil {
+			t.Fatal(err)
+		}
+		bs, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var total int
+		for off, rec := range recs {
+			if string(bs[off:off+int64(len(rec))]) != rec {
+				t.Fatalf("%+v: record %q not found at %d", opts, rec, off)
+			}
+			total += len(rec)
+		}
+		if len(recs) != 400 || total != len(bs) {
+			t.Fatalf("%+v: %d records of %d bytes, file has %d bytes", opts, len(recs), total, len(bs))
+		}
+	}
+}
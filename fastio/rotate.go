@@ -0,0 +1,430 @@
+// Copyright (c) 2023, donnie <donnie4w@gmail.com>
+// All rights reserved.
+// Use of t source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// github.com/donnie4w/gofer/fastio
+
+package fastio
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/donnie4w/gofer/compress"
+)
+
+// RotateNaming determines the names of rotated files
+type RotateNaming int
+
+const (
+	// NameTimestamp names an archive after the time of rotation, e.g. app-20231019T150405.000.log
+	NameTimestamp RotateNaming = iota
+	// NameSequence numbers the archives, e.g. app-000001.log
+	NameSequence
+)
+
+// Compression is the compression of rotated files
+type Compression int
+
+const (
+	CompressNone Compression = iota
+	CompressGzip
+	CompressZstd
+)
+
+const timestampLayout = "20060102T150405.000"
+
+var _ File = (*RotatingFile)(nil)
+
+// RotateOptions configures a RotatingFile
+type RotateOptions struct {
+	// MaxSize is the size in bytes at which the file is rotated, zero disables size rotation
+	MaxSize int64
+	// Interval is the time after which the file is rotated, zero disables time rotation
+	Interval time.Duration
+	Naming   RotateNaming
+	// Compress compresses rotated files in the background
+	Compress Compression
+	// MaxBackups is the number of rotated files to keep, the oldest are removed; zero keeps all
+	MaxBackups int
+	// File configures the underlying File
+	File *Options
+}
+
+// RotatingFile is a File that moves its content to an archive file once it reached a maximum size or age,
+// and continues in a new, empty file. Rotation is atomic with respect to concurrent writes: a write goes
+// entirely to the old or entirely to the new file. Offsets and reads refer to the current file.
+type RotatingFile struct {
+	path    string
+	opts    RotateOptions
+	mu      sync.RWMutex // writes hold the read lock, rotation holds the write lock
+	file    File
+	size    int64 // bytes reserved by writes to the current file
+	expire  int64 // unix nanoseconds at which the current file is rotated
+	seq     int64 // last sequence number
+	closed  bool
+	bg      sync.WaitGroup // compression and removal of archives
+	archive sync.Mutex     // serializes the background work
+}
+
+// OpenRotating opens or creates the file at path for appending
+func OpenRotating(path string, opts *RotateOptions) (r *RotatingFile, err error) {
+	r = &RotatingFile{path: path}
+	if opts != nil {
+		r.opts = *opts
+	}
+	if r.file, err = OpenWithOptions(path, r.opts.File); err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		r.file.Close()
+		return nil, err
+	}
+	r.size = fi.Size()
+	r.resetExpire()
+	if r.opts.Naming == NameSequence {
+		for _, a := range r.archives() {
+			if n, ok := r.sequenceOf(a); ok && n > r.seq {
+				r.seq = n
+			}
+		}
+	}
+	return
+}
+
+func (r *RotatingFile) resetExpire() {
+	if r.opts.Interval > 0 {
+		atomic.StoreInt64(&r.expire, time.Now().Add(r.opts.Interval).UnixNano())
+	}
+}
+
+// acquire takes the read lock for a write of n bytes, rotating the file first if the write would
+// exceed MaxSize or the file expired
+func (r *RotatingFile) acquire(n int64) (f File, err error) {
+	for {
+		r.mu.RLock()
+		if r.closed {
+			r.mu.RUnlock()
+			return nil, ErrClosed
+		}
+		size := atomic.LoadInt64(&r.size)
+		full := r.opts.MaxSize > 0 && size > 0 && size+n > r.opts.MaxSize
+		expired := r.opts.Interval > 0 && size > 0 && time.Now().UnixNano() >= atomic.LoadInt64(&r.expire)
+		if full || expired {
+			f := r.file
+			r.mu.RUnlock()
+			if err = r.rotate(f); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if atomic.CompareAndSwapInt64(&r.size, size, size+n) {
+			return r.file, nil
+		}
+		r.mu.RUnlock()
+	}
+}
+
+func (r *RotatingFile) Write(b []byte) (n int, err error) {
+	f, err := r.acquire(int64(len(b)))
+	if err != nil {
+		return 0, err
+	}
+	defer r.mu.RUnlock()
+	return f.Write(b)
+}
+
+func (r *RotatingFile) WriteSync(b []byte) (offset int64, err error) {
+	f, err := r.acquire(int64(len(b)))
+	if err != nil {
+		return 0, err
+	}
+	defer r.mu.RUnlock()
+	return f.WriteSync(b)
+}
+
+func (r *RotatingFile) WriteV(bufs [][]byte) (offset int64, err error) {
+	f, err := r.acquire(size(bufs))
+	if err != nil {
+		return 0, err
+	}
+	defer r.mu.RUnlock()
+	return f.WriteV(bufs)
+}
+
+// WriteVBatch writes the records to the current file, the batch is not split by a rotation
+func (r *RotatingFile) WriteVBatch(records [][][]byte) (offsets []int64, err error) {
+	var n int64
+	for _, bufs := range records {
+		n += size(bufs)
+	}
+	f, err := r.acquire(n)
+	if err != nil {
+		return nil, err
+	}
+	defer r.mu.RUnlock()
+	return f.WriteVBatch(records)
+}
+
+func size(bufs [][]byte) (n int64) {
+	for _, b := range bufs {
+		n += int64(len(b))
+	}
+	return
+}
+
+// WriteAt writes to the current file, it does not rotate
+func (r *RotatingFile) WriteAt(b []byte, off int64) (n int, err error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.closed {
+		return 0, ErrClosed
+	}
+	if n, err = r.file.WriteAt(b, off); err == nil {
+		for {
+			size := atomic.LoadInt64(&r.size)
+			if off+int64(n) <= size || atomic.CompareAndSwapInt64(&r.size, size, off+int64(n)) {
+				break
+			}
+		}
+	}
+	return
+}
+
+func (r *RotatingFile) ReadAt(b []byte, off int64) (n int, err error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.closed {
+		return 0, ErrClosed
+	}
+	return r.file.ReadAt(b, off)
+}
+
+func (r *RotatingFile) Read(b []byte) (n int, err error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.closed {
+		return 0, ErrClosed
+	}
+	return r.file.Read(b)
+}
+
+// Sync commits the current file to stable storage
+func (r *RotatingFile) Sync() error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.closed {
+		return ErrClosed
+	}
+	return r.file.Sync()
+}
+
+// Size returns the size of the current file
+func (r *RotatingFile) Size() (int64, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.closed {
+		return 0, ErrClosed
+	}
+	return r.file.Size()
+}
+
+// Truncate truncates the current file
+func (r *RotatingFile) Truncate(size int64) (err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return ErrClosed
+	}
+	if err = r.file.Truncate(size); err == nil {
+		r.size = size
+	}
+	return
+}
+
+// Rotate rotates the file now, unless it is empty
+func (r *RotatingFile) Rotate() error {
+	r.mu.RLock()
+	f := r.file
+	r.mu.RUnlock()
+	return r.rotate(f)
+}
+
+// rotate archives the current file and opens a new one, unless another caller rotated f already
+func (r *RotatingFile) rotate(f File) (err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return ErrClosed
+	}
+	if r.file != f || r.size == 0 {
+		return nil
+	}
+	if err = r.file.Close(); err != nil {
+		return
+	}
+	archive := r.archiveName()
+	renameErr := os.Rename(r.path, archive)
+	// the file is reopened even if the rename failed, so that writes continue
+	if r.file, err = OpenWithOptions(r.path, r.opts.File); err != nil {
+		r.closed = true
+		return
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+	r.size = 0
+	r.resetExpire()
+	r.bg.Add(1)
+	go r.finish(archive)
+	return
+}
+
+// split returns the directory, the name without extension and the extension of the path of r
+func (r *RotatingFile) split() (dir, name, ext string) {
+	dir, name = filepath.Dir(r.path), filepath.Base(r.path)
+	ext = filepath.Ext(name)
+	return dir, strings.TrimSuffix(name, ext), ext
+}
+
+func (r *RotatingFile) archiveName() string {
+	dir, name, ext := r.split()
+	if r.opts.Naming == NameSequence {
+		r.seq++
+		return filepath.Join(dir, fmt.Sprintf("%s-%06d%s", name, r.seq, ext))
+	}
+	stamp := time.Now().Format(timestampLayout)
+	for i := 1; ; i++ {
+		// two rotations within a millisecond
+		p := filepath.Join(dir, name+"-"+stamp+ext)
+		if i > 1 {
+			p = filepath.Join(dir, fmt.Sprintf("%s-%s.%d%s", name, stamp, i, ext))
+		}
+		if !exists(p) && !exists(p+".gz") && !exists(p+".zst") {
+			return p
+		}
+	}
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return !os.IsNotExist(err)
+}
+
+// finish compresses a new archive and removes the archives beyond MaxBackups
+func (r *RotatingFile) finish(archive string) {
+	defer r.bg.Done()
+	r.archive.Lock()
+	defer r.archive.Unlock()
+	if r.opts.Compress != CompressNone {
+		compressFile(archive, r.opts.Compress)
+	}
+	if r.opts.MaxBackups > 0 {
+		as := r.archives()
+		for i := 0; i < len(as)-r.opts.MaxBackups; i++ {
+			os.Remove(as[i])
+		}
+	}
+}
+
+func compressFile(path string, c Compression) (err error) {
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	var ext string
+	switch c {
+	case CompressGzip:
+		bs, err = compress.Gzip(bs)
+		ext = ".gz"
+	case CompressZstd:
+		bs, err = compress.Zstd(bs)
+		ext = ".zst"
+	}
+	if err != nil {
+		return
+	}
+	tmp := path + ext + ".tmp"
+	if err = os.WriteFile(tmp, bs, 0666); err == nil {
+		if err = os.Rename(tmp, path+ext); err == nil {
+			return os.Remove(path)
+		}
+	}
+	os.Remove(tmp)
+	return
+}
+
+// archives returns the rotated files of r, oldest first
+func (r *RotatingFile) archives() (as []string) {
+	dir, name, _ := r.split()
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		n := e.Name()
+		if e.IsDir() || !strings.HasPrefix(n, name+"-") {
+			continue
+		}
+		if _, ok := r.stampOf(filepath.Join(dir, n)); ok {
+			as = append(as, filepath.Join(dir, n))
+		}
+	}
+	sort.Slice(as, func(i, j int) bool {
+		a, _ := r.stampOf(as[i])
+		b, _ := r.stampOf(as[j])
+		return a < b
+	})
+	return
+}
+
+// stampOf returns the sortable part of the name of an archive of r
+func (r *RotatingFile) stampOf(archive string) (string, bool) {
+	_, name, ext := r.split()
+	s := strings.TrimPrefix(filepath.Base(archive), name+"-")
+	s = strings.TrimSuffix(strings.TrimSuffix(s, ".gz"), ".zst")
+	if !strings.HasSuffix(s, ext) {
+		return "", false
+	}
+	s = strings.TrimSuffix(s, ext)
+	if r.opts.Naming == NameSequence {
+		n, err := strconv.ParseInt(s, 10, 64)
+		return fmt.Sprintf("%020d", n), err == nil
+	}
+	if len(s) < len(timestampLayout) {
+		return "", false
+	}
+	if _, err := time.Parse(timestampLayout, s[:len(timestampLayout)]); err != nil {
+		return "", false
+	}
+	return s, true
+}
+
+func (r *RotatingFile) sequenceOf(archive string) (int64, bool) {
+	s, ok := r.stampOf(archive)
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	return n, err == nil
+}
+
+// Close closes the current file and waits for the background compression of archives
+func (r *RotatingFile) Close() (err error) {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return ErrClosed
+	}
+	r.closed = true
+	err = r.file.Close()
+	r.mu.Unlock()
+	r.bg.Wait()
+	return
+}
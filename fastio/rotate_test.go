@@ -0,0 +1,192 @@
+// Copyright (c) 2023, donnie <donnie4w@gmail.com>
+// All rights reserved.
+// Use of t source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// github.com/donnie4w/gofer/fastio
+
+package fastio
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/donnie4w/gofer/compress"
+)
+
+func listDir(t *testing.T, dir string) (names []string) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	return
+}
+
+func TestRotateConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	const rec, maxSize = 16, 1000
+	r, err := OpenRotating(filepath.Join(dir, "app.log"), &RotateOptions{MaxSize: maxSize, Naming: NameSequence})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				bs := []byte(fmt.Sprintf("%02d-%012d\n", g, i))
+				var err error
+				if i%2 == 0 {
+					_, err = r.Write(bs)
+				} else {
+					_, err = r.WriteSync(bs)
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	if err = r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	seen := map[string]bool{}
+	names := listDir(t, dir)
+	if len(names) < 1600*rec/maxSize {
+		t.Fatalf("only %d files after rotation", len(names))
+	}
+	for _, name := range names {
+		bs, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(bs) > maxSize || len(bs)%rec != 0 {
+			t.Fatalf("%s has %d bytes", name, len(bs))
+		}
+		for ; len(bs) > 0; bs = bs[rec:] {
+			s := string(bs[:rec])
+			if seen[s] || s[rec-1] != '\n' {
+				t.Fatalf("%s: duplicate or torn record %q", name, s)
+			}
+			seen[s] = true
+		}
+	}
+	if len(seen) != 1600 {
+		t.Fatalf("%d of 1600 records found", len(seen))
+	}
+}
+
+func TestRotateNaming(t *testing.T) {
+	for naming, pattern := range map[RotateNaming]string{
+		NameSequence:  `^app-00000[1-3]\.log$`,
+		NameTimestamp: `^app-\d{8}T\d{6}\.\d{3}(\.\d+)?\.log$`,
+	} {
+		dir := t.TempDir()
+		r, err := OpenRotating(filepath.Join(dir, "app.log"), &RotateOptions{Naming: naming})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 3; i++ {
+			r.Write([]byte("x"))
+			if err = r.Rotate(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		r.Close()
+		names := listDir(t, dir)
+		if len(names) != 4 || names[len(names)-1] != "app.log" {
+			t.Fatalf("naming %d: unexpected files %v", naming, names)
+		}
+		for _, name := range names[:3] {
+			if !regexp.MustCompile(pattern).MatchString(name) {
+				t.Fatalf("naming %d: unexpected archive %s", naming, name)
+			}
+		}
+	}
+}
+
+func TestRotateCompress(t *testing.T) {
+	for c, ext := range map[Compression]string{CompressGzip: ".gz", CompressZstd: ".zst"} {
+		dir := t.TempDir()
+		r, err := OpenRotating(filepath.Join(dir, "app.log"), &RotateOptions{Naming: NameSequence, Compress: c})
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := bytes.Repeat([]byte("rotated data\n"), 100)
+		r.Write(data)
+		if err = r.Rotate(); err != nil {
+			t.Fatal(err)
+		}
+		// Close waits for the compression
+		r.Close()
+		if names := listDir(t, dir); len(names) != 2 || names[0] != "app-000001.log"+ext {
+			t.Fatalf("unexpected files %v", names)
+		}
+		bs, err := os.ReadFile(filepath.Join(dir, "app-000001.log"+ext))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c == CompressGzip {
+			bs, err = compress.UnGzip(bs)
+		} else {
+			bs, err = compress.UnZstd(bs)
+		}
+		if err != nil || !bytes.Equal(bs, data) {
+			t.Fatalf("%s: archive does not decompress to the data: %v", ext, err)
+		}
+	}
+}
+
+func TestRotateMaxBackups(t *testing.T) {
+	dir := t.TempDir()
+	r, err := OpenRotating(filepath.Join(dir, "app.log"), &RotateOptions{Naming: NameSequence, MaxBackups: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		r.Write([]byte("x"))
+		if err = r.Rotate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.Close()
+	if names := fmt.Sprint(listDir(t, dir)); names != "[app-000004.log app-000005.log app.log]" {
+		t.Fatalf("unexpected files %s", names)
+	}
+}
+
+func TestRotateSequenceResume(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.log")
+	for i := 0; i < 2; i++ {
+		r, err := OpenRotating(path, &RotateOptions{Naming: NameSequence, Compress: CompressGzip})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < 2; j++ {
+			r.Write([]byte("x"))
+			if err = r.Rotate(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		r.Close()
+	}
+	want := "[app-000001.log.gz app-000002.log.gz app-000003.log.gz app-000004.log.gz app.log]"
+	if names := fmt.Sprint(listDir(t, dir)); names != want {
+		t.Fatalf("unexpected files %s", names)
+	}
+}
@@ -0,0 +1,26 @@
+// Copyright (c) 2023, donnie <donnie4w@gmail.com>
+// All rights reserved.
+// Use of t source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// github.com/donnie4w/gofer/fastio
+
+//go:build linux
+// +build linux
+
+package fastio
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// datasync flushes the data of f to stable storage, skipping metadata that is not needed to read it back
+func datasync(f *os.File) error {
+	for {
+		if err := unix.Fdatasync(int(f.Fd())); err != unix.EINTR {
+			return err
+		}
+	}
+}
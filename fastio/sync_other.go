@@ -0,0 +1,19 @@
+// Copyright (c) 2023, donnie <donnie4w@gmail.com>
+// All rights reserved.
+// Use of t source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// github.com/donnie4w/gofer/fastio
+
+//go:build !linux
+// +build !linux
+
+package fastio
+
+import (
+	"os"
+)
+
+func datasync(f *os.File) error {
+	return f.Sync()
+}
@@ -0,0 +1,68 @@
+// Copyright (c) 2023, donnie <donnie4w@gmail.com>
+// All rights reserved.
+// Use of t source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// github.com/donnie4w/gofer/fastio
+
+//go:build linux
+// +build linux
+
+package fastio
+
+import (
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+const maxIovecs = 1024
+
+// writev writes bufs to f with as few writev calls as possible
+func writev(f *os.File, bufs [][]byte) (n int64, err error) {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	bufs = append([][]byte(nil), bufs...)
+	werr := rc.Write(func(fd uintptr) bool {
+		for len(bufs) > 0 {
+			var c int
+			c, err = unix.Writev(int(fd), bufs[:min(len(bufs), maxIovecs)])
+			if err == unix.EINTR {
+				err = nil
+				continue
+			}
+			if err == unix.EAGAIN {
+				err = nil
+				return false
+			}
+			if err == nil && c == 0 {
+				err = io.ErrShortWrite
+			}
+			if err != nil {
+				return true
+			}
+			n += int64(c)
+			// drop what was written, a short write continues in the middle of a buffer
+			for c > 0 && len(bufs) > 0 {
+				if c >= len(bufs[0]) {
+					c -= len(bufs[0])
+					bufs = bufs[1:]
+				} else {
+					bufs[0] = bufs[0][c:]
+					c = 0
+				}
+			}
+			for len(bufs) > 0 && len(bufs[0]) == 0 {
+				bufs = bufs[1:]
+			}
+		}
+		return true
+	})
+	if err == nil {
+		err = werr
+	}
+	return
+}
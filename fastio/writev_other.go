@@ -0,0 +1,29 @@
+// Copyright (c) 2023, donnie <donnie4w@gmail.com>
+// All rights reserved.
+// Use of t source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// github.com/donnie4w/gofer/fastio
+
+//go:build !linux
+// +build !linux
+
+package fastio
+
+import (
+	"os"
+)
+
+// writev writes bufs to f with one write
+func writev(f *os.File, bufs [][]byte) (int64, error) {
+	size := 0
+	for _, b := range bufs {
+		size += len(b)
+	}
+	buf := make([]byte, 0, size)
+	for _, b := range bufs {
+		buf = append(buf, b...)
+	}
+	n, err := f.Write(buf)
+	return int64(n), err
+}
@@ -23,6 +23,9 @@ type _keyStore struct {
 	mux          *sync.Mutex
 	fname        string
 	_fileHandler *os.File
+	key          *StoreKey
+	dk           []byte      // the key derived from key for hdr
+	hdr          storeHeader // kdf parameters and salt of the file
 }
 
 func NewKeyStore(dir string, name string) (ks *_keyStore, err error) {
@@ -36,7 +39,128 @@ func LoadKeyStore(dir string, name string) (ks *_keyStore, err error) {
 	fname := fmt.Sprint(dir, "/", name)
 	var _fileHandler *os.File
 	if _fileHandler, err = os.OpenFile(fname, os.O_RDWR|os.O_CREATE, 0666); err == nil {
-		ks = &_keyStore{&sync.Mutex{}, fname, _fileHandler}
+		ks = &_keyStore{mux: &sync.Mutex{}, fname: fname, _fileHandler: _fileHandler}
+	}
+	return
+}
+
+// SetKey sets the key of an encrypted store. A plaintext store is encrypted with k, an encrypted
+// store must have been encrypted with k.
+func (this *_keyStore) SetKey(k *StoreKey) (err error) {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	var raw []byte
+	if raw, err = this.readRaw(); err != nil {
+		return
+	}
+	if encrypted(raw) {
+		var h storeHeader
+		if h, err = decodeHeader(raw); err != nil {
+			return
+		}
+		var dk []byte
+		if dk, err = k.derive(&h); err != nil {
+			return
+		}
+		if _, err = open(h, dk, raw); err == nil {
+			this.key, this.dk, this.hdr = k, dk, h
+		}
+		return
+	}
+	// upgrade a plaintext store
+	return this.rekey(k, raw)
+}
+
+// Rotate encrypts the store with a new key k, the old key is no longer accepted
+func (this *_keyStore) Rotate(k *StoreKey) (err error) {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	var raw []byte
+	if raw, err = this.readRaw(); err != nil {
+		return
+	}
+	if encrypted(raw) {
+		if raw, err = this.decrypt(raw); err != nil {
+			return
+		}
+	}
+	return this.rekey(k, raw)
+}
+
+// rekey writes the zlib-compressed data encrypted with k under a new salt
+func (this *_keyStore) rekey(k *StoreKey, compressed []byte) (err error) {
+	var h storeHeader
+	if h, err = newHeader(k); err != nil {
+		return
+	}
+	var dk []byte
+	if dk, err = k.derive(&h); err != nil {
+		return
+	}
+	if len(compressed) > 0 {
+		var bs []byte
+		if bs, err = seal(h, dk, compressed); err != nil {
+			return
+		}
+		if err = this.replace(bs); err != nil {
+			return
+		}
+	}
+	this.key, this.dk, this.hdr = k, dk, h
+	return
+}
+
+// decrypt returns the zlib-compressed data of an encrypted store
+func (this *_keyStore) decrypt(raw []byte) (bs []byte, err error) {
+	if this.key == nil {
+		return nil, ErrLocked
+	}
+	h, err := decodeHeader(raw)
+	if err != nil {
+		return
+	}
+	dk := this.dk
+	if h.kdf != this.hdr.kdf || h.logN != this.hdr.logN || h.r != this.hdr.r || h.p != this.hdr.p || h.salt != this.hdr.salt {
+		// written by another instance
+		if dk, err = this.key.derive(&h); err != nil {
+			return
+		}
+	}
+	return open(h, dk, raw)
+}
+
+func (this *_keyStore) readRaw() (bs []byte, err error) {
+	fi, err := this._fileHandler.Stat()
+	if err != nil || fi.Size() == 0 {
+		return
+	}
+	return util.ReadFile(this.fname)
+}
+
+// replace writes bs to a temporary file and renames it over the store, so that a crash leaves
+// either the old or the new store
+func (this *_keyStore) replace(bs []byte) (err error) {
+	tmp := this.fname + ".tmp"
+	if err = os.WriteFile(tmp, bs, 0600); err != nil {
+		return
+	}
+	var f *os.File
+	if f, err = os.OpenFile(tmp, os.O_RDWR, 0); err == nil {
+		err = f.Sync()
+		f.Close()
+	}
+	if err == nil {
+		this._fileHandler.Close()
+		err = os.Rename(tmp, this.fname)
+		// reopen the store even if the rename failed
+		if f, e := os.OpenFile(this.fname, os.O_RDWR|os.O_CREATE, 0666); e == nil {
+			this._fileHandler = f
+		} else if err == nil {
+			err = e
+		}
+	}
+	if err != nil {
+		os.Remove(tmp)
 	}
 	return
 }
@@ -44,12 +168,23 @@ func LoadKeyStore(dir string, name string) (ks *_keyStore, err error) {
 func (this *_keyStore) Write(bs []byte) (err error) {
 	this.mux.Lock()
 	defer this.mux.Unlock()
-	this._fileHandler.Seek(0, io.SeekStart)
-	this._fileHandler.Truncate(0)
 	var obs []byte
 	if obs, err = util.Zlib(bs); err != nil {
 		obs = bs
 	}
+	if this.key != nil {
+		if obs, err = seal(this.hdr, this.dk, obs); err != nil {
+			return
+		}
+		return this.replace(obs)
+	}
+	hdr := make([]byte, storeHeaderSize)
+	if n, _ := this._fileHandler.ReadAt(hdr, 0); encrypted(hdr[:n]) {
+		// do not overwrite an encrypted store with plaintext
+		return ErrLocked
+	}
+	this._fileHandler.Seek(0, io.SeekStart)
+	this._fileHandler.Truncate(0)
 	_, err = this._fileHandler.Write(obs)
 	return
 }
@@ -57,14 +192,16 @@ func (this *_keyStore) Write(bs []byte) (err error) {
 func (this *_keyStore) Read() (bs []byte, err error) {
 	this.mux.Lock()
 	defer this.mux.Unlock()
-	fi, err := this._fileHandler.Stat()
-	if fi.Size() > 0 {
-		if bs, err = util.ReadFile(this.fname); err == nil && bs != nil {
-			if obs, er := util.UnZlib(bs); er == nil {
-				return obs, er
+	if bs, err = this.readRaw(); err == nil && len(bs) > 0 {
+		if encrypted(bs) {
+			if bs, err = this.decrypt(bs); err != nil {
+				return nil, err
 			}
 		}
-	} else {
+		if obs, er := util.UnZlib(bs); er == nil {
+			return obs, er
+		}
+	} else if err == nil {
 		err = errors.New("empty file")
 	}
 	return
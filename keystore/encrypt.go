@@ -0,0 +1,178 @@
+// Copyright (c) 2023, donnie <donnie4w@gmail.com>
+// All rights reserved.
+// Use of t source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// github.com/donnie4w/gofer/keystore
+
+package keystore
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"os"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+var (
+	ErrLocked = errors.New("keystore: store is encrypted and no key is set")
+	ErrKey    = errors.New("keystore: wrong key or corrupted store")
+)
+
+// an encrypted store is a header followed by the AES-256-GCM sealed, zlib-compressed data,
+// the header is authenticated as additional data. The header is
+// magic(4) version(1) kdf(1) scrypt logN(1) r(1) p(1) salt(16) nonce(12).
+const (
+	storeVersion    = 1
+	storeHeaderSize = 37
+	kdfScrypt       = 1
+	kdfRaw          = 2
+	masterKeySize   = 32
+)
+
+var storeMagic = []byte("GKSE")
+
+// default scrypt parameters for passphrases, stored in the header of each file
+const (
+	scryptLogN = 15
+	scryptR    = 8
+	scryptP    = 1
+)
+
+// StoreKey is the key that encrypts a keystore file, either a passphrase or a master key
+type StoreKey struct {
+	kdf    byte
+	secret []byte
+}
+
+// PassphraseKey returns a key derived from passphrase with scrypt
+func PassphraseKey(passphrase string) *StoreKey {
+	return &StoreKey{kdf: kdfScrypt, secret: []byte(passphrase)}
+}
+
+// LoadMasterKey reads a master key of 32 bytes, hex encoded, from the file at path
+func LoadMasterKey(path string) (*StoreKey, error) {
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(string(bytes.TrimSpace(bs)))
+	if err != nil || len(key) != masterKeySize {
+		return nil, errors.New("keystore: master key file must hold 32 hex encoded bytes")
+	}
+	return &StoreKey{kdf: kdfRaw, secret: key}, nil
+}
+
+// NewMasterKeyFile creates the file at path with a new random master key, readable by the owner only
+func NewMasterKeyFile(path string) (*StoreKey, error) {
+	key := make([]byte, masterKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = f.WriteString(hex.EncodeToString(key) + "\n"); err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	return &StoreKey{kdf: kdfRaw, secret: key}, nil
+}
+
+type storeHeader struct {
+	kdf, logN, r, p byte
+	salt            [16]byte
+	nonce           [12]byte
+}
+
+// newHeader returns a header for k with a new salt
+func newHeader(k *StoreKey) (h storeHeader, err error) {
+	h.kdf = k.kdf
+	if k.kdf == kdfScrypt {
+		h.logN, h.r, h.p = scryptLogN, scryptR, scryptP
+		_, err = rand.Read(h.salt[:])
+	}
+	return
+}
+
+func (h *storeHeader) encode() []byte {
+	b := make([]byte, 0, storeHeaderSize)
+	b = append(b, storeMagic...)
+	b = append(b, storeVersion, h.kdf, h.logN, h.r, h.p)
+	b = append(b, h.salt[:]...)
+	return append(b, h.nonce[:]...)
+}
+
+func encrypted(bs []byte) bool {
+	return len(bs) >= storeHeaderSize && bytes.HasPrefix(bs, storeMagic)
+}
+
+func decodeHeader(bs []byte) (h storeHeader, err error) {
+	if !encrypted(bs) || bs[4] != storeVersion {
+		return h, errors.New("keystore: unsupported store format")
+	}
+	h.kdf, h.logN, h.r, h.p = bs[5], bs[6], bs[7], bs[8]
+	copy(h.salt[:], bs[9:25])
+	copy(h.nonce[:], bs[25:storeHeaderSize])
+	return
+}
+
+// derive returns the AES key of k for the kdf parameters and salt of h
+func (k *StoreKey) derive(h *storeHeader) ([]byte, error) {
+	if k.kdf != h.kdf {
+		return nil, ErrKey
+	}
+	if k.kdf == kdfRaw {
+		return k.secret, nil
+	}
+	if h.logN == 0 || h.logN > 30 {
+		return nil, ErrKey
+	}
+	return scrypt.Key(k.secret, h.salt[:], 1<<h.logN, int(h.r), int(h.p), 32)
+}
+
+// seal encrypts data with dk under a new nonce
+func seal(h storeHeader, dk, data []byte) ([]byte, error) {
+	aead, err := newGCM(dk)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = rand.Read(h.nonce[:]); err != nil {
+		return nil, err
+	}
+	hdr := h.encode()
+	return aead.Seal(hdr, h.nonce[:], data, hdr), nil
+}
+
+// open decrypts an encrypted store with dk
+func open(h storeHeader, dk, bs []byte) ([]byte, error) {
+	aead, err := newGCM(dk)
+	if err != nil {
+		return nil, err
+	}
+	data, err := aead.Open(nil, h.nonce[:], bs[storeHeaderSize:], bs[:storeHeaderSize])
+	if err != nil {
+		return nil, ErrKey
+	}
+	return data, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(c)
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2023, donnie <donnie4w@gmail.com>
+// All rights reserved.
+// Use of t source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// github.com/donnie4w/gofer/keystore
+package keystore
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEncryptedStore(t *testing.T) {
+	dir := t.TempDir()
+	ks, err := NewKeyStore(dir, "keystore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := []byte("user hashes and other secrets")
+	if err = ks.Write(secret); err != nil {
+		t.Fatal(err)
+	}
+
+	// upgrade the plaintext store
+	if err = ks.SetKey(PassphraseKey("pass")); err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := os.ReadFile(filepath.Join(dir, "keystore"))
+	if !encrypted(raw) || bytes.Contains(raw, secret) {
+		t.Fatal("store not encrypted")
+	}
+	if bs, err := ks.Read(); err != nil || !bytes.Equal(bs, secret) {
+		t.Fatal(err, string(bs))
+	}
+
+	// reopen without a key, with a wrong key and with the right key
+	ks2, _ := LoadKeyStore(dir, "keystore")
+	if _, err = ks2.Read(); err != ErrLocked {
+		t.Fatal(err)
+	}
+	if err = ks2.Write([]byte("plain")); err != ErrLocked {
+		t.Fatal(err)
+	}
+	if err = ks2.SetKey(PassphraseKey("wrong")); err != ErrKey {
+		t.Fatal(err)
+	}
+	if err = ks2.SetKey(PassphraseKey("pass")); err != nil {
+		t.Fatal(err)
+	}
+	if bs, err := ks2.Read(); err != nil || !bytes.Equal(bs, secret) {
+		t.Fatal(err, string(bs))
+	}
+
+	// rotate to a master key file
+	mk, err := NewMasterKeyFile(filepath.Join(dir, "master.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ks2.Rotate(mk); err != nil {
+		t.Fatal(err)
+	}
+	ks2.Write(append(secret, '!'))
+	ks3, _ := LoadKeyStore(dir, "keystore")
+	if err = ks3.SetKey(PassphraseKey("pass")); err != ErrKey {
+		t.Fatal(err)
+	}
+	mk, err = LoadMasterKey(filepath.Join(dir, "master.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ks3.SetKey(mk); err != nil {
+		t.Fatal(err)
+	}
+	if bs, err := ks3.Read(); err != nil || string(bs) != string(secret)+"!" {
+		t.Fatal(err, string(bs))
+	}
+}
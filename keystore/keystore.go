@@ -14,12 +14,60 @@ import (
 )
 
 type storeAdmin struct {
-	kb  *KeyBean
-	mux *sync.Mutex
+	kb     *KeyBean
+	mux    *sync.Mutex
+	hasher PasswordHasher
 }
 
 func NewStoreAdmin() *storeAdmin {
-	return &storeAdmin{mux: &sync.Mutex{}}
+	return &storeAdmin{mux: &sync.Mutex{}, hasher: DefaultArgon2id}
+}
+
+// SetHasher sets the hasher of new passwords. Passwords hashed otherwise are rehashed on their next
+// successful verification.
+func (this *storeAdmin) SetHasher(h PasswordHasher) {
+	defer this.mux.Unlock()
+	this.mux.Lock()
+	this.hasher = h
+}
+
+func (this *storeAdmin) putUser(users func(*KeyBean) map[string]*UserBean, name, pwd string, _type int8) (err error) {
+	this.mux.Lock()
+	h := this.hasher
+	this.mux.Unlock()
+	var encoded string
+	if encoded, err = h.Hash(pwd); err != nil {
+		return
+	}
+	defer this.mux.Unlock()
+	this.mux.Lock()
+	users(this.kb)[name] = &UserBean{name, encoded, _type}
+	return KeyStore.Write(util.TEncode(this.kb))
+}
+
+// verifyUser checks pwd against the user name of users. The hash is computed without holding the lock;
+// an outdated hash, such as a legacy MD5 hash, is replaced after a successful verification.
+func (this *storeAdmin) verifyUser(users func(*KeyBean) map[string]*UserBean, name, pwd string) bool {
+	this.mux.Lock()
+	u, ok := users(this.kb)[name]
+	h := this.hasher
+	this.mux.Unlock()
+	if !ok {
+		return false
+	}
+	ok, rehash := verifyPassword(h, u.Pwd, pwd)
+	if ok && rehash {
+		if encoded, err := h.Hash(pwd); err == nil {
+			defer this.mux.Unlock()
+			this.mux.Lock()
+			// the user may have been changed meanwhile
+			if m := users(this.kb); m[name] == u {
+				m[name] = &UserBean{u.Name, encoded, u.Type}
+				KeyStore.Write(util.TEncode(this.kb))
+			}
+		}
+	}
+	return ok
 }
 
 func (this *storeAdmin) Load() {
@@ -35,11 +83,13 @@ func (this *storeAdmin) Load() {
 	}
 }
 
-func (this *storeAdmin) PutAdmin(name, pwd string, _type int8) {
-	defer this.mux.Unlock()
-	this.mux.Lock()
-	this.kb.Admin[name] = &UserBean{name, util.Md5Str(pwd), _type}
-	KeyStore.Write(util.TEncode(this.kb))
+func (this *storeAdmin) PutAdmin(name, pwd string, _type int8) error {
+	return this.putUser((*KeyBean).GetAdmin, name, pwd, _type)
+}
+
+// VerifyAdmin reports whether pwd is the password of the admin user name
+func (this *storeAdmin) VerifyAdmin(name, pwd string) bool {
+	return this.verifyUser((*KeyBean).GetAdmin, name, pwd)
 }
 
 func (this *storeAdmin) DelAdmin(name string) {
@@ -68,11 +118,13 @@ func (this *storeAdmin) AdminList() (ss []string) {
 	return
 }
 
-func (this *storeAdmin) PutClient(name, pwd string, _type int8) {
-	defer this.mux.Unlock()
-	this.mux.Lock()
-	this.kb.Client[name] = &UserBean{name, util.Md5Str(pwd), _type}
-	KeyStore.Write(util.TEncode(this.kb))
+func (this *storeAdmin) PutClient(name, pwd string, _type int8) error {
+	return this.putUser((*KeyBean).GetClient, name, pwd, _type)
+}
+
+// VerifyClient reports whether pwd is the password of the client user name
+func (this *storeAdmin) VerifyClient(name, pwd string) bool {
+	return this.verifyUser((*KeyBean).GetClient, name, pwd)
 }
 
 func (this *storeAdmin) DelClient(name string) {
@@ -101,11 +153,13 @@ func (this *storeAdmin) ClientList() (ss []string) {
 	return
 }
 
-func (this *storeAdmin) PutMq(name, pwd string, _type int8) {
-	defer this.mux.Unlock()
-	this.mux.Lock()
-	this.kb.Mq[name] = &UserBean{name, util.Md5Str(pwd), _type}
-	KeyStore.Write(util.TEncode(this.kb))
+func (this *storeAdmin) PutMq(name, pwd string, _type int8) error {
+	return this.putUser((*KeyBean).GetMq, name, pwd, _type)
+}
+
+// VerifyMq reports whether pwd is the password of the mq user name
+func (this *storeAdmin) VerifyMq(name, pwd string) bool {
+	return this.verifyUser((*KeyBean).GetMq, name, pwd)
 }
 
 func (this *storeAdmin) DelMq(name string) {
@@ -0,0 +1,138 @@
+// Copyright (c) 2023, donnie <donnie4w@gmail.com>
+// All rights reserved.
+// Use of t source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// github.com/donnie4w/gofer/keystore
+
+package keystore
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/donnie4w/gofer/util"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordHasher hashes the passwords of the keystore. The encoded hash includes the algorithm,
+// its parameters and the salt, so that hashes of different hashers and parameters can coexist.
+type PasswordHasher interface {
+	// Hash returns the encoded hash of pwd with a new random salt
+	Hash(pwd string) (string, error)
+	// Verify reports whether pwd matches encoded, and whether encoded should be replaced
+	// because it was hashed with other parameters than the hasher's
+	Verify(encoded, pwd string) (ok, rehash bool)
+	// Recognizes reports whether encoded is in the format of the hasher
+	Recognizes(encoded string) bool
+}
+
+// Argon2id hashes passwords with argon2id, encoded in the PHC string format
+// $argon2id$v=19$m=<memory>,t=<time>,p=<threads>$<salt>$<hash>
+type Argon2id struct {
+	Time    uint32
+	Memory  uint32 // in KiB
+	Threads uint8
+	KeyLen  uint32
+	SaltLen uint32
+}
+
+// DefaultArgon2id follows the parameters recommended by RFC 9106 for memory-constrained environments
+var DefaultArgon2id = &Argon2id{Time: 3, Memory: 64 * 1024, Threads: 4, KeyLen: 32, SaltLen: 16}
+
+const argon2idPrefix = "$argon2id$"
+
+func (h *Argon2id) Hash(pwd string) (string, error) {
+	salt := make([]byte, h.SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(pwd), salt, h.Time, h.Memory, h.Threads, h.KeyLen)
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2idPrefix, argon2.Version, h.Memory, h.Time, h.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (h *Argon2id) Verify(encoded, pwd string) (ok, rehash bool) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return
+	}
+	var version int
+	var p Argon2id
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads); err != nil || p.Threads == 0 {
+		return
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return
+	}
+	p.SaltLen, p.KeyLen = uint32(len(salt)), uint32(len(key))
+	ok = subtle.ConstantTimeCompare(argon2.IDKey([]byte(pwd), salt, p.Time, p.Memory, p.Threads, p.KeyLen), key) == 1
+	return ok, p != *h
+}
+
+func (h *Argon2id) Recognizes(encoded string) bool {
+	return strings.HasPrefix(encoded, argon2idPrefix)
+}
+
+// Bcrypt hashes passwords with bcrypt, passwords longer than 72 bytes are rejected
+type Bcrypt struct {
+	Cost int
+}
+
+var DefaultBcrypt = &Bcrypt{Cost: bcrypt.DefaultCost}
+
+func (h *Bcrypt) Hash(pwd string) (string, error) {
+	bs, err := bcrypt.GenerateFromPassword([]byte(pwd), h.Cost)
+	return string(bs), err
+}
+
+func (h *Bcrypt) Verify(encoded, pwd string) (ok, rehash bool) {
+	if bcrypt.CompareHashAndPassword([]byte(encoded), []byte(pwd)) != nil {
+		return
+	}
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return true, err != nil || cost != h.Cost
+}
+
+func (h *Bcrypt) Recognizes(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$")
+}
+
+// isLegacy reports whether encoded is an unsalted MD5 hash as stored by earlier versions
+func isLegacy(encoded string) bool {
+	if len(encoded) != 32 {
+		return false
+	}
+	for _, c := range encoded {
+		if !(c >= '0' && c <= '9' || c >= 'A' && c <= 'F' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// verifyPassword reports whether pwd matches encoded, and whether encoded should be replaced by a hash of h
+func verifyPassword(h PasswordHasher, encoded, pwd string) (ok, rehash bool) {
+	if isLegacy(encoded) {
+		return subtle.ConstantTimeCompare([]byte(strings.ToUpper(encoded)), []byte(util.Md5Str(pwd))) == 1, true
+	}
+	for _, k := range []PasswordHasher{h, DefaultArgon2id, DefaultBcrypt} {
+		if k.Recognizes(encoded) {
+			ok, rehash = k.Verify(encoded, pwd)
+			return ok, rehash || k != h
+		}
+	}
+	return
+}
@@ -0,0 +1,64 @@
+// Copyright (c) 2023, donnie <donnie4w@gmail.com>
+// All rights reserved.
+// Use of t source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// github.com/donnie4w/gofer/keystore
+package keystore
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/donnie4w/gofer/util"
+)
+
+func TestVerifyPassword(t *testing.T) {
+	var err error
+	if KeyStore, err = NewKeyStore(t.TempDir(), "keystore"); err != nil {
+		t.Fatal(err)
+	}
+	sa := NewStoreAdmin()
+	sa.Load()
+	if err = sa.PutAdmin("admin", "secret", 1); err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := sa.GetAdmin("admin"); !strings.HasPrefix(u.Pwd, "$argon2id$") {
+		t.Fatal(u.Pwd)
+	}
+	if !sa.VerifyAdmin("admin", "secret") || sa.VerifyAdmin("admin", "Secret") || sa.VerifyAdmin("nobody", "secret") {
+		t.Fatal("admin verification")
+	}
+
+	// a legacy MD5 hash is migrated on login
+	sa.kb.Client["legacy"] = &UserBean{"legacy", util.Md5Str("pwd"), 2}
+	if sa.VerifyClient("legacy", "wrong") {
+		t.Fatal("legacy verification")
+	}
+	if u, _ := sa.GetClient("legacy"); u.Pwd != util.Md5Str("pwd") {
+		t.Fatal("migrated on failed login")
+	}
+	if !sa.VerifyClient("legacy", "pwd") {
+		t.Fatal("legacy verification")
+	}
+	sa2 := NewStoreAdmin()
+	sa2.Load()
+	if u, _ := sa2.GetClient("legacy"); !strings.HasPrefix(u.Pwd, "$argon2id$") || u.Type != 2 {
+		t.Fatal("not migrated", u)
+	}
+	if !sa2.VerifyClient("legacy", "pwd") {
+		t.Fatal("migrated verification")
+	}
+
+	// switching the hasher rehashes on login
+	sa2.SetHasher(&Bcrypt{Cost: 4})
+	sa2.PutMq("mq", "m", 0)
+	if !sa2.VerifyAdmin("admin", "secret") || !sa2.VerifyMq("mq", "m") {
+		t.Fatal("verification after switching")
+	}
+	for _, u := range []*UserBean{sa2.kb.Admin["admin"], sa2.kb.Mq["mq"]} {
+		if !strings.HasPrefix(u.Pwd, "$2a$") {
+			t.Fatal("not rehashed", u.Pwd)
+		}
+	}
+}
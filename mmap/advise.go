@@ -0,0 +1,104 @@
+// Copyright (c) 2023, donnie <donnie4w@gmail.com>
+// All rights reserved.
+// Use of t source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// github.com/donnie4w/gofer/mmap
+
+package mmap
+
+import (
+	"os"
+	"runtime"
+)
+
+// Advice tells the kernel how a range of the mapping will be accessed
+type Advice int
+
+const (
+	// Normal resets the advice of a range
+	Normal Advice = iota
+	// Sequential expects reads in ascending order, pages are read ahead aggressively and dropped early
+	Sequential
+	// Random expects reads in random order, read-ahead is disabled
+	Random
+	// WillNeed expects the range to be read soon, it is read ahead in the background
+	WillNeed
+	// DontNeed expects the range not to be read soon, its pages may be dropped from memory
+	DontNeed
+)
+
+// pages returns the part of the mapping that holds n bytes from off of the mapped range,
+// starting at a page boundary as required by madvise and mlock. t.mux must be held.
+func (t *Mmap) pages(off, n int64) ([]byte, error) {
+	if off < 0 || n < 0 || off+n > t.maxsize {
+		return nil, ErrOutOfRange
+	}
+	page := int64(os.Getpagesize())
+	start := (t.delta + off) / page * page
+	return t._mmap[start : t.delta+off+n], nil
+}
+
+// Advise gives the kernel advice about n bytes from off of the mapped range, it is a no-op on
+// platforms without madvise. DontNeed on a COPY mapping discards the changes to the range.
+func (t *Mmap) Advise(advice Advice, off, n int64) error {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	b, err := t.pages(off, n)
+	if err != nil || len(b) == 0 {
+		return err
+	}
+	return madvise(b, advice)
+}
+
+// Prefetch reads n bytes from off of the mapped range into memory and returns when they are resident,
+// so that later accesses do not block on page faults
+func (t *Mmap) Prefetch(off, n int64) error {
+	if err := t.Advise(WillNeed, off, n); err != nil {
+		return err
+	}
+	b, err := t.Slice(off, n)
+	if err != nil {
+		return err
+	}
+	var s byte
+	page := os.Getpagesize()
+	for i := 0; i < len(b); i += page {
+		s += b[i]
+	}
+	if len(b) > 0 {
+		s += b[len(b)-1]
+	}
+	runtime.KeepAlive(s)
+	return nil
+}
+
+// Lock locks the mapping in memory, so that it is not paged out. A mapping created by a later grow
+// is locked as well. It is a no-op on platforms without mlock.
+func (t *Mmap) Lock() (err error) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if t.locked {
+		return
+	}
+	if err = mlock(t._mmap); err == nil {
+		t.locked = true
+	}
+	return
+}
+
+// Unlock reverses Lock
+func (t *Mmap) Unlock() (err error) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if !t.locked {
+		return
+	}
+	for _, mm := range t.retired {
+		munlock(mm)
+	}
+	if err = munlock(t._mmap); err == nil {
+		t.locked = false
+	}
+	return
+}
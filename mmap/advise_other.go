@@ -0,0 +1,23 @@
+// Copyright (c) 2023, donnie <donnie4w@gmail.com>
+// All rights reserved.
+// Use of t source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// github.com/donnie4w/gofer/mmap
+
+//go:build wasm || solaris
+// +build wasm solaris
+
+package mmap
+
+func madvise(b []byte, advice Advice) error {
+	return nil
+}
+
+func mlock(b []byte) error {
+	return nil
+}
+
+func munlock(b []byte) error {
+	return nil
+}
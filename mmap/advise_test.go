@@ -0,0 +1,54 @@
+// Copyright (c) 2023, donnie <donnie4w@gmail.com>
+// All rights reserved.
+// Use of t source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// github.com/donnie4w/gofer/mmap
+
+package mmap
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestAdviseSubRange(t *testing.T) {
+	page := os.Getpagesize()
+	f := openFile(t, pattern(4*page))
+	m, err := NewMMAPWithOptions(f, &Options{Offset: int64(page + 100), Length: int64(2 * page)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Unmap()
+	n := m.FileSize()
+	for _, a := range []Advice{Sequential, Random, WillNeed, Normal} {
+		if err = m.Advise(a, 1, 300); err != nil {
+			t.Fatalf("Advise(%d): %v", a, err)
+		}
+		if err = m.Advise(a, 0, n); err != nil {
+			t.Fatalf("Advise(%d) of the whole range: %v", a, err)
+		}
+	}
+	if err = m.Advise(WillNeed, 1, n); err != ErrOutOfRange {
+		t.Fatalf("Advise beyond the range: %v", err)
+	}
+	if err = m.Prefetch(7, n-7); err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Prefetch(-1, 1); err != ErrOutOfRange {
+		t.Fatalf("Prefetch before the range: %v", err)
+	}
+	if err = m.Lock(); errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.ENOMEM) {
+		t.Skipf("mlock not permitted: %v", err)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if m.Bytes()[0] != byte((page+100)%251) {
+		t.Fatal("advice changed the mapping")
+	}
+}
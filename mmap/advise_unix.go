@@ -0,0 +1,40 @@
+// Copyright (c) 2023, donnie <donnie4w@gmail.com>
+// All rights reserved.
+// Use of t source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// github.com/donnie4w/gofer/mmap
+
+//go:build !windows && !wasm && !solaris
+// +build !windows,!wasm,!solaris
+
+package mmap
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+func madvise(b []byte, advice Advice) error {
+	var a int
+	switch advice {
+	case Sequential:
+		a = unix.MADV_SEQUENTIAL
+	case Random:
+		a = unix.MADV_RANDOM
+	case WillNeed:
+		a = unix.MADV_WILLNEED
+	case DontNeed:
+		a = unix.MADV_DONTNEED
+	default:
+		a = unix.MADV_NORMAL
+	}
+	return unix.Madvise(b, a)
+}
+
+func mlock(b []byte) error {
+	return unix.Mlock(b)
+}
+
+func munlock(b []byte) error {
+	return unix.Munlock(b)
+}
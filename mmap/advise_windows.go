@@ -0,0 +1,30 @@
+// Copyright (c) 2023, donnie <donnie4w@gmail.com>
+// All rights reserved.
+// Use of t source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// github.com/donnie4w/gofer/mmap
+
+//go:build windows
+// +build windows
+
+package mmap
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// madvise is a no-op, windows has no equivalent for mapped files
+func madvise(b []byte, advice Advice) error {
+	return nil
+}
+
+func mlock(b []byte) error {
+	return windows.VirtualLock(uintptr(unsafe.Pointer(&b[0])), uintptr(len(b)))
+}
+
+func munlock(b []byte) error {
+	return windows.VirtualUnlock(uintptr(unsafe.Pointer(&b[0])), uintptr(len(b)))
+}
@@ -0,0 +1,19 @@
+// Copyright (c) 2023, donnie <donnie4w@gmail.com>
+// All rights reserved.
+// Use of t source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// github.com/donnie4w/gofer/mmap
+
+//go:build !linux
+// +build !linux
+
+package mmap
+
+import (
+	"os"
+)
+
+func allocate(file *os.File, size int64) error {
+	return file.Truncate(size)
+}
@@ -0,0 +1,155 @@
+// Copyright (c) 2023, donnie <donnie4w@gmail.com>
+// All rights reserved.
+// Use of t source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// github.com/donnie4w/gofer/mmap
+
+package mmap
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"os"
+)
+
+// HeaderSize is the size of the header kept with Options.Header
+const HeaderSize = 2 * slotSize
+
+const (
+	headerMagic   = 0x474d4150 // "GMAP"
+	headerVersion = 1
+	// the header holds two slots that are written alternately, so that a torn write of one slot
+	// leaves the other intact. A slot is magic(4) version(2) reserved(2) seq(8) committed(8)
+	// data crc(4) slot crc(4).
+	slotSize = 32
+)
+
+var ErrCorrupt = errors.New("mmap: header or committed data is corrupt")
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+type header struct {
+	seq       uint64
+	committed int64  // length of the data covered by the header
+	crc       uint32 // checksum of data[:committed]
+	dirty     bool   // committed data was overwritten since the last commit
+	torn      bool   // data beyond the committed length was found on recover
+}
+
+func (t *Mmap) headerBytes() []byte {
+	return t._mmap[t.delta-t.hsize : t.delta]
+}
+
+func decodeSlot(b []byte) (h header, ok bool) {
+	if binary.BigEndian.Uint32(b) != headerMagic || binary.BigEndian.Uint16(b[4:]) != headerVersion {
+		return
+	}
+	if crc32.Checksum(b[:28], castagnoli) != binary.BigEndian.Uint32(b[28:]) {
+		return
+	}
+	h.seq = binary.BigEndian.Uint64(b[8:])
+	h.committed = int64(binary.BigEndian.Uint64(b[16:]))
+	h.crc = binary.BigEndian.Uint32(b[24:])
+	return h, h.committed >= 0
+}
+
+func encodeSlot(b []byte, h header) {
+	binary.BigEndian.PutUint32(b, headerMagic)
+	binary.BigEndian.PutUint16(b[4:], headerVersion)
+	binary.BigEndian.PutUint16(b[6:], 0)
+	binary.BigEndian.PutUint64(b[8:], h.seq)
+	binary.BigEndian.PutUint64(b[16:], uint64(h.committed))
+	binary.BigEndian.PutUint32(b[24:], h.crc)
+	binary.BigEndian.PutUint32(b[28:], crc32.Checksum(b[:28], castagnoli))
+}
+
+// recover reads the header and sets the append offset to the committed length. A header that is all
+// zero belongs to a new file. If the newest slot does not match the data, the older one is used.
+func (t *Mmap) recover() error {
+	hb := t.headerBytes()
+	a, aok := decodeSlot(hb[:slotSize])
+	b, bok := decodeSlot(hb[slotSize:])
+	if !aok && !bok {
+		for _, c := range hb {
+			if c != 0 {
+				return ErrCorrupt
+			}
+		}
+		if t.offset > t.maxsize || (t.offset == t.maxsize && t.growth == 0) {
+			return errors.New("offset Exceeds the file limit")
+		}
+		return nil
+	}
+	slots := make([]header, 0, 2)
+	if aok {
+		slots = append(slots, a)
+	}
+	if bok {
+		slots = append(slots, b)
+	}
+	if len(slots) == 2 && slots[1].seq > slots[0].seq {
+		slots[0], slots[1] = slots[1], slots[0]
+	}
+	for i, h := range slots {
+		if h.committed <= t.maxsize && crc32.Checksum(t.data[:h.committed], castagnoli) == h.crc {
+			t.hdr, t.offset = h, h.committed
+			t.hdr.torn = i > 0 || !zero(t.data[h.committed:min(h.committed+int64(os.Getpagesize()), t.maxsize)])
+			return nil
+		}
+	}
+	return ErrCorrupt
+}
+
+func zero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// commit writes the data up to the append offset to disk, then the header that covers it
+func (t *Mmap) commit() (err error) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	end := t.offset
+	if end == t.hdr.committed && !t.hdr.dirty {
+		return
+	}
+	h := t.hdr
+	from := h.committed
+	if h.dirty {
+		from, h.crc = 0, 0
+	}
+	h.crc = crc32.Update(h.crc, castagnoli, t.data[from:end])
+	if err = t.msync(t.delta+from, int(end-from)); err != nil {
+		return
+	}
+	h.seq++
+	h.committed, h.dirty = end, false
+	slot := int64(h.seq%2) * slotSize
+	encodeSlot(t.headerBytes()[slot:], h)
+	if err = t.msync(t.delta-t.hsize+slot, slotSize); err != nil {
+		return
+	}
+	t.hdr = h
+	return
+}
+
+// Committed returns the length of the data covered by the header
+func (t *Mmap) Committed() int64 {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	return t.hdr.committed
+}
+
+// Torn reports whether the header found data that was written but not committed when the file
+// was opened, that data is beyond the recovered offset and is overwritten by later appends
+func (t *Mmap) Torn() bool {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	return t.hdr.torn
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2023, donnie <donnie4w@gmail.com>
+// All rights reserved.
+// Use of t source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// github.com/donnie4w/gofer/mmap
+
+package mmap
+
+import (
+	"os"
+	"testing"
+)
+
+func openHeader(t *testing.T, f *os.File) *Mmap {
+	t.Helper()
+	m, err := NewMMAPWithOptions(f, &Options{Header: true, InitialSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// corrupt flips a byte of the file at off
+func corrupt(t *testing.T, f *os.File, off int64) {
+	t.Helper()
+	b := make([]byte, 1)
+	if _, err := f.ReadAt(b, off); err != nil {
+		t.Fatal(err)
+	}
+	b[0] ^= 0xff
+	if _, err := f.WriteAt(b, off); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHeaderTorn(t *testing.T) {
+	f := openFile(t, nil)
+	m := openHeader(t, f)
+	if _, err := m.AppendSync([]byte("committed")); err != nil {
+		t.Fatal(err)
+	}
+	m.Append([]byte("uncommitted"))
+	// unmapping without Flush leaves the append uncommitted
+	m.Unmap()
+
+	m = openHeader(t, f)
+	defer m.Unmap()
+	if m.Committed() != 9 || !m.Torn() {
+		t.Fatalf("committed %d, torn %v", m.Committed(), m.Torn())
+	}
+	if off, err := m.Append([]byte("next")); err != nil || off != 9 {
+		t.Fatalf("append at %d after recovery: %v", off, err)
+	}
+	if string(m.Bytes()[:13]) != "committednext" {
+		t.Fatalf("unexpected data %q", m.Bytes()[:13])
+	}
+}
+
+func TestHeaderSlotFallback(t *testing.T) {
+	f := openFile(t, nil)
+	m := openHeader(t, f)
+	m.AppendSync([]byte("a"))
+	m.AppendSync([]byte("bb"))
+	m.Unmap()
+	// the second commit is in the first slot
+	corrupt(t, f, 20)
+
+	m = openHeader(t, f)
+	defer m.Unmap()
+	if m.Committed() != 1 || !m.Torn() {
+		t.Fatalf("committed %d, torn %v", m.Committed(), m.Torn())
+	}
+	if err := m.Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHeaderCorruptData(t *testing.T) {
+	f := openFile(t, nil)
+	m := openHeader(t, f)
+	m.AppendSync([]byte("hello"))
+	m.AppendSync([]byte("world"))
+	m.Unmap()
+	corrupt(t, f, HeaderSize+1)
+	if _, err := NewMMAPWithOptions(f, &Options{Header: true}); err != ErrCorrupt {
+		t.Fatalf("expected ErrCorrupt, got %v", err)
+	}
+}
@@ -9,103 +9,393 @@ package mmap
 
 import (
 	"errors"
+	"io"
 	"os"
 	"sync"
+	"sync/atomic"
 
 	gommap "github.com/edsrzf/mmap-go"
 )
 
+const defaultGrowthFactor = 2
+
+var (
+	ErrReadOnly   = errors.New("mmap: mapping is read-only")
+	ErrOutOfRange = errors.New("mmap: range exceeds the mapping")
+)
+
+// Mode is the protection of a mapping
+type Mode int
+
+const (
+	// RDWR maps the file read-write, writes go to the file
+	RDWR Mode = iota
+	// RDONLY maps the file read-only, writes return ErrReadOnly
+	RDONLY
+	// COPY maps the file copy-on-write, writes change the memory of this process only
+	COPY
+)
+
+func (m Mode) prot() int {
+	switch m {
+	case RDONLY:
+		return gommap.RDONLY
+	case COPY:
+		return gommap.COPY
+	}
+	return gommap.RDWR
+}
+
+// Options configures a Mmap
+type Options struct {
+	// Mode is the protection of the mapping, the default is RDWR
+	Mode Mode
+	// Offset is the position in the file at which the mapping starts
+	Offset int64
+	// Length is the number of bytes mapped, zero maps the file from Offset to its end. In RDWR mode
+	// a range beyond the end of the file extends the file, in the other modes the range is cut at its end.
+	Length int64
+	// StartOffset is the append offset, relative to Offset
+	StartOffset int64
+	// Grow extends the file and remaps it when Append or WriteAt would exceed the mapping, it requires RDWR
+	Grow bool
+	// GrowthFactor is the factor by which the file grows, the default is 2
+	GrowthFactor float64
+	// InitialSize is the size an empty file is extended to, the default is one page if Grow is set
+	InitialSize int64
+	// Header keeps a header of HeaderSize bytes at Offset that records the committed length, it is
+	// updated by AppendSync, WriteAtSync and Flush. On reopen the append offset is recovered from it
+	// and StartOffset is ignored.
+	Header bool
+}
+
 func NewMMAP(f *os.File, startOffset int64) (m *Mmap, err error) {
+	return NewMMAPWithOptions(f, &Options{StartOffset: startOffset})
+}
+
+func NewMMAPWithOptions(f *os.File, opts *Options) (m *Mmap, err error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	if opts.Grow && opts.Mode != RDWR {
+		return nil, errors.New("mmap: grow requires RDWR mode")
+	}
+	if opts.Offset < 0 || opts.Length < 0 {
+		return nil, ErrOutOfRange
+	}
 	fif, err := f.Stat()
 	if err != nil {
 		return nil, err
 	}
-	if fif.Size() == 0 {
-		return nil, errors.New("the file capacity is zero")
+	var hsize int64
+	if opts.Header {
+		hsize = HeaderSize
 	}
-
-	_mmap, err := gommap.Map(f, gommap.RDWR, 0)
-	if err != nil {
-		return nil, err
+	size := fif.Size() - opts.Offset - hsize
+	if opts.Length > 0 {
+		size = min(size, opts.Length)
+	}
+	if size <= 0 {
+		initial := opts.InitialSize
+		if initial <= 0 && opts.Grow {
+			initial = int64(os.Getpagesize())
+		}
+		if initial <= 0 {
+			return nil, errors.New("the file capacity is zero")
+		}
+		if opts.Mode != RDWR {
+			return nil, ErrReadOnly
+		}
+		if err = allocate(f, opts.Offset+hsize+initial); err != nil {
+			return nil, err
+		}
+		size = initial
+	} else if opts.Length > size && opts.Mode == RDWR {
+		// a range beyond the end of the file extends the file
+		if err = allocate(f, opts.Offset+hsize+opts.Length); err != nil {
+			return nil, err
+		}
+		size = opts.Length
 	}
-	if startOffset >= fif.Size() {
+	if !opts.Header && opts.StartOffset >= size && !(opts.Grow && opts.StartOffset == size) {
 		return nil, errors.New("offset Exceeds the file limit")
 	}
-	m = &Mmap{file: f, _mmap: _mmap, maxsize: fif.Size(), mux: &sync.Mutex{}, offset: startOffset}
+	m = &Mmap{file: f, mux: &sync.Mutex{}, offset: opts.StartOffset, mode: opts.Mode, base: opts.Offset, hsize: hsize}
+	if err = m.mapRegion(size); err != nil {
+		return nil, err
+	}
+	if opts.Grow {
+		m.growth = opts.GrowthFactor
+		if m.growth <= 1 {
+			m.growth = defaultGrowthFactor
+		}
+	}
+	if opts.Header {
+		if err = m.recover(); err != nil {
+			m.Unmap()
+			return nil, err
+		}
+	}
 	return
 }
 
 type Mmap struct {
 	file    *os.File
-	_mmap   gommap.MMap
+	_mmap   gommap.MMap // the mapping, starting at the page boundary at or before base
+	data    []byte      // the mapped range, _mmap[delta:delta+maxsize]
+	delta   int64       // position of the mapped range in _mmap
+	base    int64       // position of the mapped range, or of its header, in the file
+	hsize   int64       // size of the header, zero without header
+	hdr     header
 	offset  int64
 	maxsize int64
 	mux     *sync.Mutex
+	mode    Mode
+	growth  float64       // zero if the mapping does not grow
+	locked  bool          // set by Lock
+	retired []gommap.MMap // mappings replaced by a grow, unmapped by Unmap
+}
+
+// mapRegion maps the header and size bytes of the file from t.base, the mapping must start at a page boundary
+func (t *Mmap) mapRegion(size int64) (err error) {
+	page := int64(os.Getpagesize())
+	delta := t.base%page + t.hsize
+	_mmap, err := gommap.MapRegion(t.file, int(delta+size), t.mode.prot(), 0, t.base-t.base%page)
+	if err != nil {
+		return
+	}
+	if t.locked {
+		if err = mlock(_mmap); err != nil {
+			_mmap.Unmap()
+			return
+		}
+	}
+	if t._mmap != nil {
+		t.retired = append(t.retired, t._mmap)
+	}
+	t._mmap, t.data, t.delta, t.maxsize = _mmap, _mmap[delta:delta+size], delta, size
+	return
+}
+
+// reserve checks that end fits into the mapping, growing it if enabled, and returns the current mapping.
+// t.mux must be held.
+func (t *Mmap) reserve(end int64) ([]byte, error) {
+	if t.mode == RDONLY {
+		return nil, ErrReadOnly
+	}
+	if end > t.maxsize {
+		if t.growth == 0 {
+			return nil, errors.New("exceeding file size limit")
+		}
+		if err := t.grow(end); err != nil {
+			return nil, err
+		}
+	}
+	return t.data, nil
+}
+
+// grow extends the file to hold at least end bytes and maps it again. The old mapping stays valid
+// until Unmap, so slices returned by Bytes and copies in progress never refer to unmapped memory;
+// both mappings share the page cache of the file.
+func (t *Mmap) grow(end int64) (err error) {
+	size := max(end, int64(float64(t.maxsize)*t.growth))
+	page := int64(os.Getpagesize())
+	size = (size + page - 1) / page * page
+	fif, err := t.file.Stat()
+	if err != nil {
+		return
+	}
+	// the file may extend beyond a sub-range, it must not be truncated
+	if fif.Size() < t.base+t.hsize+size {
+		if err = allocate(t.file, t.base+t.hsize+size); err != nil {
+			return
+		}
+	}
+	return t.mapRegion(size)
+}
+
+// Remap maps the range up to the end of the file again if the file was extended since it was mapped,
+// e.g. by a writer in another process. A slice returned earlier stays valid until Unmap.
+func (t *Mmap) Remap() (err error) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	fif, err := t.file.Stat()
+	if err != nil {
+		return
+	}
+	if size := fif.Size() - t.base - t.hsize; size > t.maxsize {
+		err = t.mapRegion(size)
+	}
+	return
 }
 
 func (t *Mmap) Append(bs []byte) (n int64, err error) {
+	_, n, err = t.append(bs)
+	return
+}
+
+func (t *Mmap) append(bs []byte) (mm []byte, n int64, err error) {
 	t.mux.Lock()
-	if t.offset+int64(len(bs)) > t.maxsize {
-		err = errors.New("exceeding file size limit")
+	if mm, err = t.reserve(t.offset + int64(len(bs))); err != nil {
 		t.mux.Unlock()
 		return
 	}
 	n = t.offset
 	t.offset += int64(len(bs))
+	if t.hsize > 0 {
+		// a commit must not see the offset before the data
+		copy(mm[n:int(n)+len(bs)], bs)
+		t.mux.Unlock()
+		return
+	}
 	t.mux.Unlock()
-	copy(t._mmap[n:int(n)+len(bs)], bs)
+	copy(mm[n:int(n)+len(bs)], bs)
 	return
 }
 
 func (t *Mmap) AppendSync(bs []byte) (n int64, err error) {
-	if n, err = t.Append(bs); err == nil {
-		err = mmapSyncToDisk(t.file, t._mmap, n, len(bs))
+	if _, n, err = t.append(bs); err == nil {
+		if t.hsize > 0 {
+			return n, t.commit()
+		}
+		err = t.sync(n, len(bs))
 	}
 	return
 }
 
 func (t *Mmap) WriteAt(bs []byte, offset int) (err error) {
+	_, err = t.writeAt(bs, offset)
+	return
+}
+
+func (t *Mmap) writeAt(bs []byte, offset int) (mm []byte, err error) {
 	t.mux.Lock()
-	if offset+len(bs) > int(t.maxsize) {
-		err = errors.New("exceeding file size limit")
+	if mm, err = t.reserve(int64(offset + len(bs))); err != nil {
 		t.mux.Unlock()
 		return
 	}
 	if int64(offset+len(bs)) > t.offset {
 		t.offset = int64(offset + len(bs))
 	}
+	if t.hsize > 0 {
+		if int64(offset) < t.hdr.committed {
+			t.hdr.dirty = true
+		}
+		copy(mm[offset:offset+len(bs)], bs)
+		t.mux.Unlock()
+		return
+	}
 	t.mux.Unlock()
-	copy(t._mmap[offset:offset+len(bs)], bs)
+	copy(mm[offset:offset+len(bs)], bs)
 	return
 }
 
 func (t *Mmap) WriteAtSync(bs []byte, offset int) (err error) {
-	if err = t.WriteAt(bs, offset); err == nil {
-		err = mmapSyncToDisk(t.file, t._mmap, int64(offset), len(bs))
+	if _, err = t.writeAt(bs, offset); err == nil {
+		if t.hsize > 0 {
+			return t.commit()
+		}
+		err = t.sync(int64(offset), len(bs))
 	}
 	return
 }
 
-func (t *Mmap) Unmap() error {
+// sync writes length bytes at offset of the mapped range to disk, a COPY mapping has no disk to write to
+func (t *Mmap) sync(offset int64, length int) error {
+	if t.mode == COPY || length == 0 {
+		return nil
+	}
+	t.mux.Lock()
+	mm, delta := t._mmap, t.delta
+	t.mux.Unlock()
+	return mmapSyncToDisk(t.file, mm, delta+offset, length)
+}
+
+// msync writes length bytes at pos of the mapping to disk. t.mux must be held.
+func (t *Mmap) msync(pos int64, length int) error {
+	if t.mode == COPY || length == 0 {
+		return nil
+	}
+	return mmapSyncToDisk(t.file, t._mmap, pos, length)
+}
+
+// storeUint64 stores v atomically at off of the mapped range, which must be 8-byte aligned
+func (t *Mmap) storeUint64(off int64, v uint64) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	atomic.StoreUint64(word64(t.data, off), v)
+	if t.hsize > 0 && off < t.hdr.committed {
+		t.hdr.dirty = true
+	}
+}
+
+// ReadAt reads len(b) bytes from off of the mapped range, it returns io.EOF if the range ends before
+func (t *Mmap) ReadAt(b []byte, off int64) (n int, err error) {
+	data := t.Bytes()
+	if off < 0 {
+		return 0, ErrOutOfRange
+	}
+	if off >= int64(len(data)) {
+		return 0, io.EOF
+	}
+	if n = copy(b, data[off:]); n < len(b) {
+		err = io.EOF
+	}
+	return
+}
+
+// Slice returns n bytes from off of the mapped range without copying. The slice refers to the mapping
+// and must not be used after Unmap, writing to it is only allowed if the mode is not RDONLY.
+func (t *Mmap) Slice(off, n int64) ([]byte, error) {
+	data := t.Bytes()
+	if off < 0 || n < 0 || off+n > int64(len(data)) {
+		return nil, ErrOutOfRange
+	}
+	return data[off : off+n : off+n], nil
+}
+
+func (t *Mmap) Unmap() (err error) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	for _, mm := range t.retired {
+		mm.Unmap()
+	}
+	t.retired = nil
 	return t._mmap.Unmap()
 }
 
 func (t *Mmap) UnmapAndCloseFile() (err error) {
-	if err = t._mmap.Unmap(); err == nil {
+	if err = t.Unmap(); err == nil {
 		err = t.file.Close()
 	}
 	return
 }
 
 func (t *Mmap) Flush() error {
-	return t._mmap.Flush()
+	if t.mode == COPY {
+		return nil
+	}
+	if t.hsize > 0 && t.mode == RDWR {
+		return t.commit()
+	}
+	t.mux.Lock()
+	mm := t._mmap
+	t.mux.Unlock()
+	return mm.Flush()
 }
 
+// Bytes returns the mapped range. After a grow, a slice returned earlier stays valid until Unmap
+// but does not cover the new part of the file.
 func (t *Mmap) Bytes() []byte {
-	return t._mmap
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	return t.data
 }
 
+// FileSize returns the size of the mapped range
 func (t *Mmap) FileSize() int64 {
+	t.mux.Lock()
+	defer t.mux.Unlock()
 	return t.maxsize
 }
 
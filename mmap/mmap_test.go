@@ -0,0 +1,242 @@
+// Copyright (c) 2023, donnie <donnie4w@gmail.com>
+// All rights reserved.
+// Use of t source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// github.com/donnie4w/gofer/mmap
+
+package mmap
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func openFile(t *testing.T, data []byte) *os.File {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "mmap")
+	if err := os.WriteFile(path, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func TestAppendGrowConcurrent(t *testing.T) {
+	f := openFile(t, nil)
+	m, err := NewMMAPWithOptions(f, &Options{Grow: true, InitialSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Unmap()
+	const goroutines, n, size = 8, 500, 64
+	offs := make([][]int64, goroutines)
+	var wg sync.WaitGroup
+	for g := range offs {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				off, err := m.Append([]byte(fmt.Sprintf("%-63d\n", g*n+i)))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				offs[g] = append(offs[g], off)
+			}
+		}(g)
+	}
+	wg.Wait()
+	total := int64(goroutines * n * size)
+	if m.FileSize() < total {
+		t.Fatalf("mapping of %d bytes after appending %d", m.FileSize(), total)
+	}
+	seen := map[int64]bool{}
+	buf := make([]byte, size)
+	for g := range offs {
+		for i, off := range offs[g] {
+			if seen[off] || off%size != 0 || off >= total {
+				t.Fatalf("unexpected offset %d", off)
+			}
+			seen[off] = true
+			if _, err = m.ReadAt(buf, off); err != nil {
+				t.Fatal(err)
+			}
+			if want := fmt.Sprintf("%-63d\n", g*n+i); string(buf) != want {
+				t.Fatalf("record at %d is %q, expected %q", off, buf, want)
+			}
+		}
+	}
+}
+
+func TestInitialSize(t *testing.T) {
+	f := openFile(t, nil)
+	m, err := NewMMAPWithOptions(f, &Options{InitialSize: 10000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi, _ := f.Stat(); fi.Size() != 10000 || m.FileSize() != 10000 {
+		t.Fatalf("file of %d bytes, mapping of %d", fi.Size(), m.FileSize())
+	}
+	if _, err = m.Append(bytes.Repeat([]byte("x"), 10000)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = m.Append([]byte("x")); err == nil {
+		t.Fatal("append beyond the mapping without Grow")
+	}
+	m.Unmap()
+
+	f = openFile(t, nil)
+	if m, err = NewMMAPWithOptions(f, &Options{Grow: true}); err != nil {
+		t.Fatal(err)
+	}
+	if m.FileSize() != int64(os.Getpagesize()) {
+		t.Fatalf("mapping of %d bytes, expected one page", m.FileSize())
+	}
+	m.Unmap()
+
+	if _, err = NewMMAPWithOptions(openFile(t, nil), nil); err == nil {
+		t.Fatal("mapping of an empty file without InitialSize")
+	}
+	if _, err = NewMMAPWithOptions(openFile(t, nil), &Options{Mode: RDONLY, InitialSize: 100}); err != ErrReadOnly {
+		t.Fatalf("expected ErrReadOnly, got %v", err)
+	}
+}
+
+// pattern returns n bytes that differ at every offset within a page
+func pattern(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i % 251)
+	}
+	return b
+}
+
+func TestModes(t *testing.T) {
+	data := pattern(2 * os.Getpagesize())
+	f := openFile(t, data)
+	if _, err := NewMMAPWithOptions(f, &Options{Mode: RDONLY, Grow: true}); err == nil {
+		t.Fatal("grow of a read-only mapping")
+	}
+	m, err := NewMMAPWithOptions(f, &Options{Mode: RDONLY})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(m.Bytes(), data) {
+		t.Fatal("read-only mapping differs from the file")
+	}
+	if _, err = m.Append([]byte("x")); err != ErrReadOnly {
+		t.Fatalf("Append: expected ErrReadOnly, got %v", err)
+	}
+	if err = m.WriteAt([]byte("x"), 0); err != ErrReadOnly {
+		t.Fatalf("WriteAt: expected ErrReadOnly, got %v", err)
+	}
+	m.Unmap()
+
+	if m, err = NewMMAPWithOptions(f, &Options{Mode: COPY}); err != nil {
+		t.Fatal(err)
+	}
+	if err = m.WriteAtSync([]byte("copy"), 10); err != nil {
+		t.Fatal(err)
+	}
+	if string(m.Bytes()[10:14]) != "copy" {
+		t.Fatal("write to the copy-on-write mapping not visible")
+	}
+	if err = m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if bs, _ := os.ReadFile(f.Name()); !bytes.Equal(bs, data) {
+		t.Fatal("write to the copy-on-write mapping changed the file")
+	}
+}
+
+func TestSubRange(t *testing.T) {
+	page := os.Getpagesize()
+	data := pattern(3 * page)
+	f := openFile(t, data)
+	off := int64(page + 100)
+	m, err := NewMMAPWithOptions(f, &Options{Offset: off, Length: 500})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.FileSize() != 500 || !bytes.Equal(m.Bytes(), data[off:off+500]) {
+		t.Fatal("sub-range does not map the range of the file")
+	}
+	if err = m.WriteAtSync([]byte("sub"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err = m.WriteAt([]byte("x"), 500); err == nil {
+		t.Fatal("write beyond the sub-range")
+	}
+	m.Close()
+	bs, _ := os.ReadFile(f.Name())
+	if string(bs[off:off+3]) != "sub" || !bytes.Equal(bs[:off], data[:off]) || !bytes.Equal(bs[off+3:], data[off+3:]) {
+		t.Fatal("write to the sub-range changed other bytes of the file")
+	}
+}
+
+func TestReadAtSliceBounds(t *testing.T) {
+	f := openFile(t, pattern(100))
+	m, err := NewMMAPWithOptions(f, &Options{Mode: RDONLY})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Unmap()
+	b := make([]byte, 10)
+	if _, err = m.ReadAt(b, -1); err != ErrOutOfRange {
+		t.Fatalf("ReadAt(-1): %v", err)
+	}
+	if _, err = m.ReadAt(b, 100); err != io.EOF {
+		t.Fatalf("ReadAt(100): %v", err)
+	}
+	if n, err := m.ReadAt(b, 95); n != 5 || err != io.EOF || !bytes.Equal(b[:5], pattern(100)[95:]) {
+		t.Fatalf("ReadAt(95): %d %v", n, err)
+	}
+	if n, err := m.ReadAt(b, 90); n != 10 || err != nil {
+		t.Fatalf("ReadAt(90): %d %v", n, err)
+	}
+	for _, r := range [][2]int64{{-1, 1}, {0, -1}, {99, 2}, {100, 1}} {
+		if _, err = m.Slice(r[0], r[1]); err != ErrOutOfRange {
+			t.Fatalf("Slice(%d, %d): %v", r[0], r[1], err)
+		}
+	}
+	s, err := m.Slice(10, 5)
+	if err != nil || len(s) != 5 || cap(s) != 5 || s[0] != 10 {
+		t.Fatalf("Slice(10, 5): %v %v", s, err)
+	}
+	if s, err = m.Slice(100, 0); err != nil || len(s) != 0 {
+		t.Fatalf("Slice(100, 0): %v", err)
+	}
+}
+
+func TestLengthBeyondEOF(t *testing.T) {
+	f := openFile(t, pattern(100))
+	m, err := NewMMAPWithOptions(f, &Options{Mode: RDONLY, Length: 8192})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.FileSize() != 100 {
+		t.Fatalf("read-only mapping of %d bytes", m.FileSize())
+	}
+	m.Unmap()
+	// RDWR extends the file to the range
+	if m, err = NewMMAPWithOptions(f, &Options{Length: 8192}); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Unmap()
+	if fi, _ := f.Stat(); fi.Size() != 8192 || m.FileSize() != 8192 {
+		t.Fatalf("file of %d bytes, mapping of %d", fi.Size(), m.FileSize())
+	}
+	if !bytes.Equal(m.Bytes()[:100], pattern(100)) {
+		t.Fatal("extension changed the data of the file")
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright (c) 2023, donnie <donnie4w@gmail.com>
+// All rights reserved.
+// Use of t source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// github.com/donnie4w/gofer/mmap
+
+package mmap
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// recordCountSize is the size of the record count at the start of a RecordFile
+const recordCountSize = 8
+
+var errUnaligned = errors.New("mmap: mapping is not 8-byte aligned")
+
+// RecordFile is an array of fixed-size records of type T stored in a Mmap. T must have a fixed
+// binary size, as required by encoding/binary. The number of records is stored in the mapping and
+// updated atomically after a record was written, so another process that maps the same file
+// can read the records while this process appends.
+type RecordFile[T any] struct {
+	m    *Mmap
+	size int64
+	mux  sync.Mutex // serializes the writers of this process
+}
+
+// NewRecordFile returns a RecordFile over m, the mapping must hold at least the record count.
+// Appending beyond the mapping requires m to grow.
+func NewRecordFile[T any](m *Mmap) (*RecordFile[T], error) {
+	var v T
+	size := binary.Size(v)
+	if size <= 0 {
+		return nil, errors.New("mmap: record type has no fixed size")
+	}
+	b := m.Bytes()
+	if len(b) < recordCountSize {
+		return nil, ErrOutOfRange
+	}
+	if uintptr(unsafe.Pointer(&b[0]))%8 != 0 {
+		return nil, errUnaligned
+	}
+	return &RecordFile[T]{m: m, size: int64(size)}, nil
+}
+
+func word64(b []byte, off int64) *uint64 {
+	return (*uint64)(unsafe.Pointer(&b[off]))
+}
+
+// Len returns the number of records
+func (r *RecordFile[T]) Len() int64 {
+	return int64(atomic.LoadUint64(word64(r.m.Bytes(), 0)))
+}
+
+// slice returns the bytes of the record at i, mapping the file again if another process extended it
+func (r *RecordFile[T]) slice(i int64) ([]byte, error) {
+	if i < 0 || i >= r.Len() {
+		return nil, ErrOutOfRange
+	}
+	off := recordCountSize + i*r.size
+	b, err := r.m.Slice(off, r.size)
+	if err == ErrOutOfRange {
+		if err = r.m.Remap(); err == nil {
+			b, err = r.m.Slice(off, r.size)
+		}
+	}
+	return b, err
+}
+
+// Get returns the record at i
+func (r *RecordFile[T]) Get(i int64) (v T, err error) {
+	b, err := r.slice(i)
+	if err == nil {
+		_, err = binary.Decode(b, binary.BigEndian, &v)
+	}
+	return
+}
+
+// Set overwrites the record at i, a concurrent Get of the same record may see a partial write
+func (r *RecordFile[T]) Set(i int64, v T) (err error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if i < 0 || i >= r.Len() {
+		return ErrOutOfRange
+	}
+	return r.write(i, v)
+}
+
+func (r *RecordFile[T]) write(i int64, v T) error {
+	buf := make([]byte, r.size)
+	if _, err := binary.Encode(buf, binary.BigEndian, v); err != nil {
+		return err
+	}
+	return r.m.WriteAt(buf, int(recordCountSize+i*r.size))
+}
+
+// Append adds v after the last record and returns its index
+func (r *RecordFile[T]) Append(v T) (i int64, err error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	i = r.Len()
+	if err = r.write(i, v); err != nil {
+		return
+	}
+	r.m.storeUint64(0, uint64(i+1))
+	return
+}
+
+// Sync writes the records and the record count to disk
+func (r *RecordFile[T]) Sync() error {
+	return r.m.Flush()
+}
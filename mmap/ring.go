@@ -0,0 +1,146 @@
+// Copyright (c) 2023, donnie <donnie4w@gmail.com>
+// All rights reserved.
+// Use of t source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// github.com/donnie4w/gofer/mmap
+
+package mmap
+
+import (
+	"errors"
+	"sync/atomic"
+	"unsafe"
+)
+
+// the control block of a ring holds the capacity, the head and the tail, head and tail
+// on separate cache lines
+const (
+	ringCap      = 0
+	ringHead     = 64
+	ringTail     = 128
+	ringDataOff  = 192
+	ringPad      = ^uint32(0) // marks the unused end of the ring before a wrapped message
+	ringHdrSize  = 4
+	ringMinBytes = ringDataOff + 8
+)
+
+var (
+	ErrFull     = errors.New("mmap: ring is full")
+	ErrTooLarge = errors.New("mmap: message exceeds the ring capacity")
+)
+
+// MmapRing is a queue of byte messages in a Mmap that is shared between processes mapping the
+// same file. Any number of producers may push concurrently, from any process, while a single
+// consumer pops. Head and tail are stored in the mapping and updated atomically. A message is
+// a length word followed by the payload, aligned to 8 bytes; the length is stored last, so the
+// consumer never sees a partial message. A producer that dies between reserving and publishing
+// a message blocks the consumer at that message.
+type MmapRing struct {
+	m    *Mmap
+	b    []byte // the ring, data from ringDataOff
+	cap  uint64
+	head *uint64 // next byte to pop
+	tail *uint64 // next byte to reserve
+}
+
+// NewMmapRing returns a ring over m. The ring is initialized if the mapping is zero, otherwise
+// it must have been created over a mapping of the same size.
+func NewMmapRing(m *Mmap) (*MmapRing, error) {
+	if m.mode == RDONLY {
+		return nil, ErrReadOnly
+	}
+	b := m.Bytes()
+	if len(b) < ringMinBytes {
+		return nil, ErrOutOfRange
+	}
+	if uintptr(unsafe.Pointer(&b[0]))%8 != 0 {
+		return nil, errUnaligned
+	}
+	r := &MmapRing{m: m, b: b, cap: uint64(len(b)-ringDataOff) &^ 7, head: word64(b, ringHead), tail: word64(b, ringTail)}
+	capp := word64(b, ringCap)
+	if !atomic.CompareAndSwapUint64(capp, 0, r.cap) && atomic.LoadUint64(capp) != r.cap {
+		return nil, errors.New("mmap: ring capacity does not match the mapping")
+	}
+	return r, nil
+}
+
+func (r *MmapRing) word32(pos uint64) *uint32 {
+	return (*uint32)(unsafe.Pointer(&r.b[ringDataOff+pos]))
+}
+
+func align8(n uint64) uint64 {
+	return (n + 7) &^ 7
+}
+
+// Push appends msg to the ring, it returns ErrFull if the ring has no space for it
+func (r *MmapRing) Push(msg []byte) error {
+	need := align8(ringHdrSize + uint64(len(msg)))
+	if need > r.cap || uint64(len(msg)) >= uint64(ringPad) {
+		return ErrTooLarge
+	}
+	var tail, pad uint64
+	for {
+		tail = atomic.LoadUint64(r.tail)
+		head := atomic.LoadUint64(r.head)
+		pos := tail % r.cap
+		// a message does not wrap, the end of the ring is skipped instead
+		pad = 0
+		if pos+need > r.cap {
+			pad = r.cap - pos
+		}
+		if tail+pad+need-head > r.cap {
+			return ErrFull
+		}
+		if atomic.CompareAndSwapUint64(r.tail, tail, tail+pad+need) {
+			break
+		}
+	}
+	if pad > 0 {
+		atomic.StoreUint32(r.word32(tail%r.cap), ringPad)
+	}
+	pos := (tail + pad) % r.cap
+	copy(r.b[ringDataOff+pos+ringHdrSize:], msg)
+	atomic.StoreUint32(r.word32(pos), uint32(len(msg))+1)
+	return nil
+}
+
+// Pop removes the oldest message and returns it appended to buf[:0]. It returns false if the ring
+// is empty or the oldest message is not yet published. Pop must not be called concurrently.
+func (r *MmapRing) Pop(buf []byte) ([]byte, bool) {
+	for {
+		head := atomic.LoadUint64(r.head)
+		pos := head % r.cap
+		h := atomic.LoadUint32(r.word32(pos))
+		switch h {
+		case 0:
+			return buf, false
+		case ringPad:
+			r.release(head, pos, r.cap-pos)
+			continue
+		}
+		n := uint64(h - 1)
+		start := ringDataOff + pos + ringHdrSize
+		buf = append(buf[:0], r.b[start:start+n]...)
+		r.release(head, pos, align8(ringHdrSize+n))
+		return buf, true
+	}
+}
+
+// release zeroes n bytes at pos, so that the length words of later messages read as unpublished,
+// and passes them to the producers
+func (r *MmapRing) release(head, pos, n uint64) {
+	atomic.StoreUint32(r.word32(pos), 0)
+	clear(r.b[ringDataOff+pos+ringHdrSize : ringDataOff+pos+n])
+	atomic.StoreUint64(r.head, head+n)
+}
+
+// Len returns the number of bytes reserved by messages that were not popped, including padding
+func (r *MmapRing) Len() int64 {
+	return int64(atomic.LoadUint64(r.tail) - atomic.LoadUint64(r.head))
+}
+
+// Cap returns the capacity of the ring in bytes
+func (r *MmapRing) Cap() int64 {
+	return int64(r.cap)
+}
@@ -0,0 +1,135 @@
+// Copyright (c) 2023, donnie <donnie4w@gmail.com>
+// All rights reserved.
+// Use of t source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// github.com/donnie4w/gofer/mmap
+
+package mmap
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+func TestRingMultiProducer(t *testing.T) {
+	f := openFile(t, make([]byte, 16<<10))
+	pm, err := NewMMAPWithOptions(f, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pm.Unmap()
+	// the consumer uses a mapping of its own, as another process would
+	cm, err := NewMMAPWithOptions(f, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Unmap()
+	producer, err := NewMmapRing(pm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	consumer, err := NewMmapRing(cm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const producers, n = 4, 2000
+	var wg sync.WaitGroup
+	for p := 0; p < producers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				msg := []byte(fmt.Sprintf("%d %d %*s", p, i, i%50, ""))
+				for {
+					err := producer.Push(msg)
+					if err == nil {
+						break
+					}
+					if err != ErrFull {
+						t.Error(err)
+						return
+					}
+					runtime.Gosched()
+				}
+			}
+		}(p)
+	}
+	next := make([]int, producers)
+	var buf []byte
+	for popped := 0; popped < producers*n; {
+		var ok bool
+		if buf, ok = consumer.Pop(buf); !ok {
+			runtime.Gosched()
+			continue
+		}
+		var p, i int
+		if _, err = fmt.Sscan(string(buf), &p, &i); err != nil {
+			t.Fatalf("torn message %q", buf)
+		}
+		if i != next[p] || len(buf) != len(fmt.Sprintf("%d %d %*s", p, i, i%50, "")) {
+			t.Fatalf("producer %d: message %d after %d", p, i, next[p]-1)
+		}
+		next[p]++
+		popped++
+	}
+	wg.Wait()
+	if producer.Len() != 0 || consumer.Len() != 0 {
+		t.Fatalf("%d bytes left in the ring", consumer.Len())
+	}
+}
+
+type record struct {
+	ID    uint64
+	Value int32
+	Tag   [4]byte
+}
+
+func TestRecordFileRemap(t *testing.T) {
+	f := openFile(t, nil)
+	wm, err := NewMMAPWithOptions(f, &Options{Grow: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wm.Unmap()
+	writer, err := NewRecordFile[record](wm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rm, err := NewMMAPWithOptions(f, &Options{Mode: RDONLY})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rm.Unmap()
+	reader, err := NewRecordFile[record](rm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := rm.FileSize()
+	// the writer grows the file beyond the mapping of the reader
+	for i := 0; i < 2000; i++ {
+		if _, err = writer.Append(record{ID: uint64(i), Value: int32(-i), Tag: [4]byte{'r', 'e', 'c', byte(i)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if reader.Len() != 2000 {
+		t.Fatalf("reader sees %d records", reader.Len())
+	}
+	for _, i := range []int64{0, 1999, 1000} {
+		r, err := reader.Get(i)
+		if err != nil || r.ID != uint64(i) || r.Value != int32(-i) || r.Tag[3] != byte(i) {
+			t.Fatalf("record %d: %+v %v", i, r, err)
+		}
+	}
+	if rm.FileSize() <= size {
+		t.Fatal("the reader did not map the extended file")
+	}
+	if _, err = reader.Get(2000); err != ErrOutOfRange {
+		t.Fatalf("Get beyond the records: %v", err)
+	}
+	if err = reader.Set(0, record{}); err != ErrReadOnly {
+		t.Fatalf("Set on a read-only mapping: %v", err)
+	}
+}
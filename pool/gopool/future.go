@@ -0,0 +1,117 @@
+// Copyright (c) 2023, donnie <donnie4w@gmail.com>
+// All rights reserved.
+// Use of t source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// github.com/donnie4w/gofer/pool/gopool
+
+package gopool
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync/atomic"
+)
+
+const (
+	futurePending int32 = iota
+	futureRunning
+	futureDone
+)
+
+// Future is the pending result of a task submitted with Submit
+type Future[T any] struct {
+	state int32
+	done  chan struct{}
+	val   T
+	err   error
+}
+
+func newFuture[T any]() *Future[T] {
+	return &Future[T]{done: make(chan struct{})}
+}
+
+// Get waits for the task to finish and returns its result, or the error of ctx if ctx is done first
+func (f *Future[T]) Get(ctx context.Context) (_r T, err error) {
+	select {
+	case <-f.done:
+		return f.val, f.err
+	case <-ctx.Done():
+		return _r, ctx.Err()
+	}
+}
+
+// Done is closed when the result of the task is available
+func (f *Future[T]) Done() <-chan struct{} {
+	return f.done
+}
+
+// start marks the task running, it returns false if the future was already completed
+func (f *Future[T]) start() bool {
+	return atomic.CompareAndSwapInt32(&f.state, futurePending, futureRunning)
+}
+
+// cancel completes a future whose task has not started yet with err
+func (f *Future[T]) cancel(err error) {
+	if atomic.CompareAndSwapInt32(&f.state, futurePending, futureDone) {
+		f.err = err
+		close(f.done)
+	}
+}
+
+func (f *Future[T]) complete(val T, err error) {
+	f.val, f.err = val, err
+	atomic.StoreInt32(&f.state, futureDone)
+	close(f.done)
+}
+
+// run executes fn for the future, a panic of fn is reported to the panic handler of g and becomes a *PanicError
+func (f *Future[T]) run(ctx context.Context, g *GoPool, fn func(ctx context.Context) (T, error)) {
+	if !f.start() {
+		return
+	}
+	var val T
+	var err error
+	defer func() {
+		if r := recover(); r != nil {
+			pe := &PanicError{Value: r, Stack: debug.Stack()}
+			g.onPanic(r, pe.Stack)
+			err = pe
+		}
+		f.complete(val, err)
+	}()
+	val, err = fn(ctx)
+}
+
+// PanicError is the error of a Future whose task panicked
+type PanicError struct {
+	Value any
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("gopool: task panic: %v", e.Value)
+}
+
+// Submit executes fn on the pool or lane and returns a Future of its result.
+// If ctx is done before fn starts, fn is skipped and the Future fails with the error of ctx.
+// If fn is rejected or discarded by the pool, the Future fails with ErrPoolFull or ErrPoolClosed.
+// A wait for room in a full queue ends when ctx is done.
+func Submit[T any](ctx context.Context, e Executor, fn func(ctx context.Context) (T, error)) *Future[T] {
+	g := e.goPool()
+	f := newFuture[T]()
+	if err := ctx.Err(); err != nil {
+		f.cancel(err)
+		return f
+	}
+	stop := context.AfterFunc(ctx, func() { f.cancel(ctx.Err()) })
+	drop := func(err error) {
+		stop()
+		f.cancel(err)
+	}
+	if err := e.submit(task{f: func() { stop(); f.run(ctx, g, fn) }, drop: drop, ctx: ctx}); err != nil {
+		drop(err)
+	}
+	return f
+}
@@ -9,60 +9,97 @@ package gopool
 
 import (
 	"context"
+	"errors"
+	"runtime"
+	"runtime/debug"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
-type funcn struct {
-	pool *GoPool
-	id   int64
-	task chan func()
-	once sync.Once
-}
+var (
+	ErrPoolClosed = errors.New("gopool: pool is shut down")
+	ErrPoolFull   = errors.New("gopool: queue is full")
+)
+
+// OverflowPolicy determines what Go does when the queue of the pool is full
+type OverflowPolicy int32
+
+const (
+	// OverflowBlock blocks the caller until the queue has room
+	OverflowBlock OverflowPolicy = iota
+	// OverflowReject rejects the function with ErrPoolFull
+	OverflowReject
+	// OverflowCallerRuns executes the function in the goroutine of the caller
+	OverflowCallerRuns
+	// OverflowDropOldest discards the oldest queued function to make room
+	OverflowDropOldest
+)
 
-func (fc *funcn) add(f func()) {
-	fc.task <- f
-	fc.once.Do(func() {
-		go fc.run()
-	})
+// task is a queued function, drop is called if the function is discarded without running
+type task struct {
+	f    func()
+	drop func(err error)
+	at   int64 // queued time in unix nanoseconds
+	// nolimit exempts the task from the rate limit, set for tasks that run other tasks
+	nolimit bool
+	// ctx bounds a blocking wait for room in the queue, nil waits until there is room
+	ctx context.Context
 }
 
-func (fc *funcn) run() {
-	defer func() {
-		if err := recover(); err != nil {
-			if fc.pool.put(fc) {
-				go fc.run()
-			}
-		}
-	}()
-	for {
-		select {
-		case f := <-fc.task:
-			f()
-		case <-fc.pool.ctx.Done():
-			goto END
-		}
-		if !fc.pool.put(fc) {
-			break
-		}
+// cancelled returns the done channel of t.ctx, or nil if t has no ctx
+func (t *task) cancelled() <-chan struct{} {
+	if t.ctx == nil {
+		return nil
 	}
-END:
+	return t.ctx.Done()
 }
 
+// closedChan is returned by waitChan when nothing is pending
+var closedChan = func() chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}()
+
 type GoPool struct {
-	pool       chan *funcn
-	minlimit   int64
-	maxlimit   int64
-	id         int64
-	count      int64
-	mux        *sync.Mutex
-	funcnPool  chan func()
-	close      bool
-	_closeflag int32
-	tnum       int64
-	ctx        context.Context
-	cancel     context.CancelFunc
+	minlimit  int64
+	maxlimit  int64
+	keepalive int64 // how long a worker above minlimit waits for a task before it exits, in nanoseconds
+	running   int64 // number of live workers
+	idle      int64 // number of workers waiting for a task
+	pending   int64 // number of accepted tasks not finished yet
+	executed  int64 // number of functions executed
+	panicked  int64 // number of functions that panicked
+	abandoned int64 // number of queued tasks discarded by Shutdown
+	rejected  int64 // number of tasks rejected or dropped by the overflow policy
+	policy    int32
+	mux       *sync.Mutex
+	zero      chan struct{} // closed when pending drops to zero, guarded by mux
+	queue     *lanes
+	deflane   *lane
+	notify    chan struct{} // wakes idle workers
+	off       int32         // set by TurnOff and Close, Go starts a goroutine per function
+	stopped   int32         // set by Shutdown, Go rejects new functions
+	ctx       context.Context
+	cancel    context.CancelFunc
+	onpanic   atomic.Pointer[func(r any, stack []byte)]
+	limit     atomic.Pointer[limiter]
+	sched     scheduler
+}
+
+// Stats is a snapshot of the counters of a pool
+type Stats struct {
+	Running int // live workers
+	Idle    int // workers waiting for a function
+	Queued  int // functions waiting for a worker, in all lanes
+	// Executed is the total number of functions executed, including those that panicked
+	Executed int64
+	Panicked int64
+	// Rejected is the total number of functions rejected or dropped by the overflow policy
+	Rejected int64
+	// Abandoned is the total number of queued functions discarded by Shutdown
+	Abandoned int64
 }
 
 func NewPool(minlimit int64, maxlimit int64) *GoPool {
@@ -71,94 +108,369 @@ func NewPool(minlimit int64, maxlimit int64) *GoPool {
 
 func NewPoolWithFuncLimit(minlimit int64, maxlimit int64, FuncLimit int) *GoPool {
 	p := &GoPool{}
-	p.pool = make(chan *funcn, minlimit)
-	p.minlimit, p.maxlimit = minlimit, maxlimit
-	if maxlimit < minlimit {
-		p.maxlimit = minlimit
-	}
-	p.funcnPool = make(chan func(), FuncLimit)
+	p.minlimit, p.maxlimit = limits(minlimit, maxlimit)
+	p.queue = &lanes{}
+	p.deflane = p.queue.add(DefaultLane, 1, FuncLimit)
+	p.notify = make(chan struct{}, p.maxlimit)
 	p.mux = &sync.Mutex{}
 	p.ctx, p.cancel = context.WithCancel(context.Background())
 	return p
 }
 
+// Go executes f on the pool. When the queue is full the overflow policy applies,
+// see SetOverflowPolicy. After Shutdown f is dropped.
 func (g *GoPool) Go(f func()) {
-	if !g.close {
-		g.funcnPool <- f
-		atomic.AddInt64(&g.tnum, 1)
-		if g.mux.TryLock() {
-			go g.funcn()
+	g.submitLane(g.deflane, task{f: f})
+}
+
+// TryGo queues f only if the queue has room, it never blocks regardless of the overflow policy
+func (g *GoPool) TryGo(f func()) bool {
+	return g.enqueue(g.deflane, task{f: f}, 0) == nil
+}
+
+// GoTimeout queues f, waiting at most d for room in the queue. It returns ErrPoolFull if the wait timed out.
+func (g *GoPool) GoTimeout(f func(), d time.Duration) error {
+	return g.enqueue(g.deflane, task{f: f}, max(d, 0))
+}
+
+func limits(minlimit, maxlimit int64) (int64, int64) {
+	return minlimit, max(maxlimit, minlimit, 1)
+}
+
+// SetLimits changes the minimum and maximum number of workers of a running pool. Workers above the
+// new maximum exit after their current function, workers above the new minimum become subject to the keep-alive.
+func (g *GoPool) SetLimits(minlimit, maxlimit int64) {
+	minlimit, maxlimit = limits(minlimit, maxlimit)
+	atomic.StoreInt64(&g.minlimit, minlimit)
+	atomic.StoreInt64(&g.maxlimit, maxlimit)
+	// idle workers check the new limits
+	for i := atomic.LoadInt64(&g.idle); i > 0; i-- {
+		select {
+		case g.notify <- struct{}{}:
+		default:
 		}
-	} else {
-		go f()
+	}
+	// start workers for the queued functions if the maximum was raised
+	for i := min(int64(g.queue.len()), maxlimit); i > 0; i-- {
+		g.wake()
 	}
 }
 
-// NumUnExecu the number of functions not executed
-func (g *GoPool) NumUnExecu() int {
-	return int(g.tnum)
+// SetKeepAlive sets how long a worker above the minimum waits for a function before it exits.
+// With the default of zero such a worker exits as soon as the queue is empty.
+func (g *GoPool) SetKeepAlive(d time.Duration) {
+	atomic.StoreInt64(&g.keepalive, int64(d))
 }
 
-// Close when Close ,the pool will enable goroutine, and the func in the pool will be started with goroutine
-func (g *GoPool) Close() {
-	defer func() { recover() }()
-	if atomic.CompareAndSwapInt32(&g._closeflag, 0, 1) {
-		g.close = true
-		g.cancel()
-		go func() {
-			<-time.After(10 * time.Second)
-			close(g.funcnPool)
-		}()
-		close(g.pool)
+// SetOverflowPolicy sets what Go and Submit do when the queue is full, the default is OverflowBlock
+func (g *GoPool) SetOverflowPolicy(p OverflowPolicy) {
+	atomic.StoreInt32(&g.policy, int32(p))
+}
+
+func (g *GoPool) goPool() *GoPool {
+	return g
+}
+
+// submit queues t on the default lane, it implements Executor
+func (g *GoPool) submit(t task) error {
+	return g.submitLane(g.deflane, t)
+}
+
+// submitLane queues t on l according to the overflow policy
+func (g *GoPool) submitLane(l *lane, t task) (err error) {
+	switch OverflowPolicy(atomic.LoadInt32(&g.policy)) {
+	case OverflowReject:
+		if err = g.enqueue(l, t, 0); err == ErrPoolFull {
+			atomic.AddInt64(&g.rejected, 1)
+		}
+	case OverflowCallerRuns:
+		if err = g.enqueue(l, t, 0); err == ErrPoolFull {
+			g.exec(t.f)
+			err = nil
+		}
+	case OverflowDropOldest:
+		for {
+			if err = g.enqueue(l, t, 0); err != ErrPoolFull {
+				return
+			}
+			if old, ok := g.queue.popLane(l); ok {
+				<-l.slots
+				atomic.AddInt64(&g.rejected, 1)
+				g.discard(old, ErrPoolFull)
+			} else {
+				// the slots are held by callers that have not queued their tasks yet
+				runtime.Gosched()
+			}
+		}
+	default:
+		err = g.enqueue(l, t, -1)
 	}
+	return
 }
 
-func (g *GoPool) TurnOff(off bool) {
-	if atomic.CompareAndSwapInt32(&g._closeflag, 0, 0) && off {
-		g.close = true
-	} else if atomic.CompareAndSwapInt32(&g._closeflag, 0, 0) && !off {
-		g.close = false
+// enqueue queues t on l; a negative wait blocks until there is room, otherwise it waits at most wait
+func (g *GoPool) enqueue(l *lane, t task, wait time.Duration) error {
+	if atomic.LoadInt32(&g.stopped) == 1 {
+		return ErrPoolClosed
 	}
+	if atomic.LoadInt32(&g.off) == 1 {
+		go g.exec(t.f)
+		return nil
+	}
+	atomic.AddInt64(&g.pending, 1)
+	switch {
+	case wait < 0:
+		select {
+		case l.slots <- struct{}{}:
+		case <-t.cancelled():
+			g.taskDone()
+			return t.ctx.Err()
+		}
+	case wait == 0:
+		select {
+		case l.slots <- struct{}{}:
+		default:
+			g.taskDone()
+			return ErrPoolFull
+		}
+	default:
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case l.slots <- struct{}{}:
+		case <-timer.C:
+			g.taskDone()
+			return ErrPoolFull
+		}
+	}
+	t.at = time.Now().UnixNano()
+	g.queue.push(l, t)
+	g.wake()
+	if g.ctx.Err() != nil {
+		// the workers were stopped while t was queued
+		g.flush()
+	}
+	return nil
 }
 
-func (g *GoPool) funcn() {
-	defer func() { recover() }()
-	defer g.mux.Unlock()
-	g._funcn()
+// wake hands the queued task to an idle worker, or starts a worker if the limit allows it
+func (g *GoPool) wake() {
+	if atomic.LoadInt64(&g.idle) > 0 {
+		select {
+		case g.notify <- struct{}{}:
+		default:
+		}
+		return
+	}
+	for {
+		n := atomic.LoadInt64(&g.running)
+		if n >= atomic.LoadInt64(&g.maxlimit) {
+			return
+		}
+		if atomic.CompareAndSwapInt64(&g.running, n, n+1) {
+			go g.worker()
+			return
+		}
+	}
 }
 
-func (g *GoPool) _funcn() {
-	for f := range g.funcnPool {
-		if g.close {
-			go f()
-		} else {
-			var t *funcn
-			if count := atomic.AddInt64(&g.count, 1); count > g.minlimit && count <= g.maxlimit {
-				t = &funcn{task: make(chan func(), 1), id: atomic.AddInt64(&g.id, 1), pool: g}
-			} else if g.id > g.minlimit {
-				t = <-g.pool
-			} else if id := atomic.AddInt64(&g.id, 1); id <= g.minlimit {
-				t = &funcn{task: make(chan func(), 1), id: id, pool: g}
-			} else {
-				t = <-g.pool
+func (g *GoPool) worker() {
+	for g.ctx.Err() == nil {
+		reap := atomic.LoadInt64(&g.keepalive) <= 0
+		if t, ok := g.queue.pop(); ok {
+			if !t.nolimit {
+				g.throttle()
+			}
+			g.exec(t.f)
+			g.taskDone()
+			if g.retire(reap) {
+				return
+			}
+			continue
+		}
+		if g.retire(reap) {
+			return
+		}
+		atomic.AddInt64(&g.idle, 1)
+		if g.queue.len() > 0 {
+			// a function queued before idle was raised did not notify this worker
+			atomic.AddInt64(&g.idle, -1)
+			continue
+		}
+		var timer *time.Timer
+		var expire <-chan time.Time
+		if atomic.LoadInt64(&g.running) > atomic.LoadInt64(&g.minlimit) {
+			timer = time.NewTimer(time.Duration(atomic.LoadInt64(&g.keepalive)))
+			expire = timer.C
+		}
+		expired := false
+		select {
+		case <-g.notify:
+		case <-g.ctx.Done():
+		case <-expire:
+			expired = true
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		atomic.AddInt64(&g.idle, -1)
+		if expired && g.retire(true) {
+			return
+		}
+	}
+	atomic.AddInt64(&g.running, -1)
+}
+
+// retire lets the worker exit if the pool has more workers than maxlimit, or if reap is set
+// and the pool has more workers than minlimit and nothing is queued
+func (g *GoPool) retire(reap bool) bool {
+	for {
+		n := atomic.LoadInt64(&g.running)
+		if n <= atomic.LoadInt64(&g.maxlimit) && (!reap || n <= atomic.LoadInt64(&g.minlimit) || g.queue.len() > 0) {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&g.running, n, n-1) {
+			// a function queued after the check above may have seen this worker as running
+			if g.queue.len() > 0 {
+				g.wake()
 			}
-			t.add(f)
+			return true
 		}
-		if atomic.AddInt64(&g.tnum, -1) <= 0 {
-			break
+	}
+}
+
+func (g *GoPool) taskDone() {
+	if atomic.AddInt64(&g.pending, -1) == 0 {
+		g.mux.Lock()
+		if g.zero != nil && atomic.LoadInt64(&g.pending) == 0 {
+			close(g.zero)
+			g.zero = nil
 		}
+		g.mux.Unlock()
+	}
+}
+
+// waitChan returns a channel that is closed once no function is pending
+func (g *GoPool) waitChan() <-chan struct{} {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	if atomic.LoadInt64(&g.pending) == 0 {
+		return closedChan
 	}
-	if g.tnum > 0 {
-		g._funcn()
+	if g.zero == nil {
+		g.zero = make(chan struct{})
+	}
+	return g.zero
+}
+
+// flush empties the queue after the workers were stopped. After Close the functions are started
+// with a goroutine each, after Shutdown they are discarded. It returns the number of discarded functions.
+func (g *GoPool) flush() (n int) {
+	for _, t := range g.queue.drain() {
+		if atomic.LoadInt32(&g.off) == 1 {
+			go func() {
+				defer g.taskDone()
+				g.exec(t.f)
+			}()
+		} else {
+			n++
+			atomic.AddInt64(&g.abandoned, 1)
+			g.discard(t, ErrPoolClosed)
+		}
 	}
 	return
 }
 
-func (g *GoPool) put(f *funcn) (ok bool) {
-	atomic.AddInt64(&g.count, -1)
-	if f.id <= g.minlimit && atomic.CompareAndSwapInt32(&g._closeflag, 0, 0) {
-		g.pool <- f
-		ok = true
+// discard drops a queued task without running it
+func (g *GoPool) discard(t task, err error) {
+	if t.drop != nil {
+		t.drop(err)
+	}
+	g.taskDone()
+}
+
+// SetPanicHandler sets the handler called with the recovered value and stack trace of a panicking task
+func (g *GoPool) SetPanicHandler(h func(r any, stack []byte)) {
+	if h == nil {
+		g.onpanic.Store(nil)
+		return
 	}
+	g.onpanic.Store(&h)
+}
+
+func (g *GoPool) onPanic(r any, stack []byte) {
+	atomic.AddInt64(&g.panicked, 1)
+	if h := g.onpanic.Load(); h != nil {
+		(*h)(r, stack)
+	}
+}
+
+// exec runs f, recovering a panic of f for the panic handler
+func (g *GoPool) exec(f func()) {
+	defer func() {
+		atomic.AddInt64(&g.executed, 1)
+		if r := recover(); r != nil {
+			g.onPanic(r, debug.Stack())
+		}
+	}()
+	f()
+}
+
+// NumUnExecu the number of functions not executed
+//
+// Deprecated: use Stats().Queued
+func (g *GoPool) NumUnExecu() int {
+	return g.queue.len()
+}
+
+// Stats returns a snapshot of the worker counts and function counters
+func (g *GoPool) Stats() Stats {
+	return Stats{
+		Running:   int(atomic.LoadInt64(&g.running)),
+		Idle:      int(atomic.LoadInt64(&g.idle)),
+		Queued:    g.queue.len(),
+		Executed:  atomic.LoadInt64(&g.executed),
+		Panicked:  atomic.LoadInt64(&g.panicked),
+		Rejected:  atomic.LoadInt64(&g.rejected),
+		Abandoned: atomic.LoadInt64(&g.abandoned),
+	}
+}
+
+// Wait blocks until every function handed to the pool so far has finished
+func (g *GoPool) Wait() {
+	<-g.waitChan()
+}
+
+// Shutdown stops accepting functions and waits for queued and running functions to finish.
+// If ctx is done first, the functions still queued are discarded; Shutdown returns their number
+// together with the error of ctx. Functions already running are not interrupted.
+func (g *GoPool) Shutdown(ctx context.Context) (abandoned int, err error) {
+	atomic.StoreInt32(&g.stopped, 1)
+	select {
+	case <-g.waitChan():
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	g.cancel()
+	abandoned = g.flush()
 	return
 }
+
+// Close when Close ,the pool will enable goroutine, and the func in the pool will be started with goroutine
+func (g *GoPool) Close() {
+	atomic.StoreInt32(&g.off, 1)
+	g.cancel()
+	g.flush()
+}
+
+// TurnOff when off, functions are started with a goroutine each instead of the pool
+func (g *GoPool) TurnOff(off bool) {
+	if g.ctx.Err() != nil {
+		return
+	}
+	if off {
+		atomic.StoreInt32(&g.off, 1)
+	} else {
+		atomic.StoreInt32(&g.off, 0)
+	}
+}
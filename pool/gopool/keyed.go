@@ -0,0 +1,226 @@
+// Copyright (c) 2023, donnie <donnie4w@gmail.com>
+// All rights reserved.
+// Use of t source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// github.com/donnie4w/gofer/pool/gopool
+
+package gopool
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/donnie4w/gofer/util"
+)
+
+const keyShards = 64
+
+// KeyedPool executes the functions of one key one at a time, in the order they were submitted,
+// while the functions of different keys run in parallel on the workers of a GoPool.
+// Every key has a bounded queue; the queue of a key is removed as soon as it has no pending function.
+type KeyedPool struct {
+	g      *GoPool
+	size   int
+	shards [keyShards]keyShard
+}
+
+type keyShard struct {
+	mux    sync.Mutex
+	queues map[string]*keyQueue
+}
+
+type keyQueue struct {
+	key     string
+	slots   chan struct{}
+	ring    ring // guarded by the mutex of the shard
+	running bool // a drain of the queue is scheduled or running
+	refs    int  // callers waiting for a slot
+}
+
+// NewKeyedPool returns a KeyedPool executing on g, every key queues at most size functions
+func NewKeyedPool(g *GoPool, size int) *KeyedPool {
+	kp := &KeyedPool{g: g, size: max(size, 1)}
+	for i := range kp.shards {
+		kp.shards[i].queues = make(map[string]*keyQueue)
+	}
+	return kp
+}
+
+// Go executes f after the functions queued for key, it blocks while the queue of key is full
+func (kp *KeyedPool) Go(key string, f func()) {
+	kp.enqueue(key, task{f: f}, -1)
+}
+
+// TryGo queues f for key only if the queue of key has room, it never blocks
+func (kp *KeyedPool) TryGo(key string, f func()) bool {
+	return kp.enqueue(key, task{f: f}, 0) == nil
+}
+
+// GoTimeout queues f for key, waiting at most d for room in the queue of key
+func (kp *KeyedPool) GoTimeout(key string, f func(), d time.Duration) error {
+	return kp.enqueue(key, task{f: f}, max(d, 0))
+}
+
+// Key returns the Executor of key, functions passed to it or to Submit with it run in order
+func (kp *KeyedPool) Key(key string) *Key {
+	return &Key{kp: kp, key: key}
+}
+
+// Keys returns the number of keys with pending functions
+func (kp *KeyedPool) Keys() (n int) {
+	for i := range kp.shards {
+		s := &kp.shards[i]
+		s.mux.Lock()
+		n += len(s.queues)
+		s.mux.Unlock()
+	}
+	return
+}
+
+func (kp *KeyedPool) shard(key string) *keyShard {
+	return &kp.shards[util.FNVHash64([]byte(key))%keyShards]
+}
+
+// enqueue queues t for key; a negative wait blocks until there is room, otherwise it waits at most wait
+func (kp *KeyedPool) enqueue(key string, t task, wait time.Duration) error {
+	g := kp.g
+	if atomic.LoadInt32(&g.stopped) == 1 {
+		return ErrPoolClosed
+	}
+	s := kp.shard(key)
+	s.mux.Lock()
+	q, ok := s.queues[key]
+	if !ok {
+		q = &keyQueue{key: key, slots: make(chan struct{}, kp.size)}
+		s.queues[key] = q
+	}
+	q.refs++
+	s.mux.Unlock()
+
+	var err error
+	switch {
+	case wait < 0:
+		select {
+		case q.slots <- struct{}{}:
+		case <-t.cancelled():
+			err = t.ctx.Err()
+		}
+	case wait == 0:
+		select {
+		case q.slots <- struct{}{}:
+		default:
+			err = ErrPoolFull
+		}
+	default:
+		timer := time.NewTimer(wait)
+		select {
+		case q.slots <- struct{}{}:
+		case <-timer.C:
+			err = ErrPoolFull
+		}
+		timer.Stop()
+	}
+
+	s.mux.Lock()
+	q.refs--
+	if err != nil {
+		kp.release(s, q)
+		s.mux.Unlock()
+		return err
+	}
+	atomic.AddInt64(&g.pending, 1)
+	q.ring.push(t)
+	schedule := !q.running
+	q.running = true
+	s.mux.Unlock()
+
+	if schedule {
+		// the functions of the key are throttled one by one by drain
+		t := task{f: func() { kp.drain(s, q) }, drop: func(err error) { kp.discard(s, q, err) }, nolimit: true}
+		if err = g.enqueue(g.deflane, t, -1); err != nil {
+			kp.discard(s, q, err)
+		}
+	}
+	return nil
+}
+
+// drain executes the functions queued for a key until the queue is empty
+func (kp *KeyedPool) drain(s *keyShard, q *keyQueue) {
+	g := kp.g
+	for {
+		if err := g.ctx.Err(); err != nil && atomic.LoadInt32(&g.off) == 0 {
+			// the pool was shut down while the key still had queued functions
+			kp.discard(s, q, ErrPoolClosed)
+			return
+		}
+		s.mux.Lock()
+		if q.ring.n == 0 {
+			q.running = false
+			kp.release(s, q)
+			s.mux.Unlock()
+			return
+		}
+		t := q.ring.pop()
+		s.mux.Unlock()
+		<-q.slots
+		g.throttle()
+		g.exec(t.f)
+		g.taskDone()
+	}
+}
+
+// discard drops the functions queued for a key without running them
+func (kp *KeyedPool) discard(s *keyShard, q *keyQueue, err error) {
+	g := kp.g
+	s.mux.Lock()
+	var ts []task
+	for q.ring.n > 0 {
+		ts = append(ts, q.ring.pop())
+		<-q.slots
+	}
+	q.running = false
+	kp.release(s, q)
+	s.mux.Unlock()
+	for _, t := range ts {
+		atomic.AddInt64(&g.abandoned, 1)
+		g.discard(t, err)
+	}
+}
+
+// release removes the queue of a key that has no pending function, s.mux must be held
+func (kp *KeyedPool) release(s *keyShard, q *keyQueue) {
+	if q.refs == 0 && q.ring.n == 0 && !q.running && s.queues[q.key] == q {
+		delete(s.queues, q.key)
+	}
+}
+
+// Key is the Executor of one key of a KeyedPool
+type Key struct {
+	kp  *KeyedPool
+	key string
+}
+
+// Go executes f after the functions queued for the key
+func (k *Key) Go(f func()) {
+	k.kp.Go(k.key, f)
+}
+
+// TryGo queues f only if the queue of the key has room
+func (k *Key) TryGo(f func()) bool {
+	return k.kp.TryGo(k.key, f)
+}
+
+// GoTimeout queues f, waiting at most d for room in the queue of the key
+func (k *Key) GoTimeout(f func(), d time.Duration) error {
+	return k.kp.GoTimeout(k.key, f, d)
+}
+
+func (k *Key) submit(t task) error {
+	return k.kp.enqueue(k.key, t, -1)
+}
+
+func (k *Key) goPool() *GoPool {
+	return k.kp.g
+}
@@ -0,0 +1,293 @@
+// Copyright (c) 2023, donnie <donnie4w@gmail.com>
+// All rights reserved.
+// Use of t source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// github.com/donnie4w/gofer/pool/gopool
+
+package gopool
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultLane is the name of the lane used by GoPool.Go
+const DefaultLane = "default"
+
+// Executor is a target of Submit, implemented by *GoPool and *Lane
+type Executor interface {
+	Go(f func())
+	TryGo(f func()) bool
+	GoTimeout(f func(), d time.Duration) error
+	submit(t task) error
+	goPool() *GoPool
+}
+
+// Lane is a named queue of a pool. Workers serve lanes with a higher weight first and,
+// while several lanes have work, weight times as often as a lane of weight 1.
+type Lane struct {
+	g *GoPool
+	l *lane
+}
+
+// Go executes f on the lane, the overflow policy of the pool applies when the lane is full
+func (l *Lane) Go(f func()) {
+	l.g.submitLane(l.l, task{f: f})
+}
+
+// TryGo queues f only if the lane has room, it never blocks
+func (l *Lane) TryGo(f func()) bool {
+	return l.g.enqueue(l.l, task{f: f}, 0) == nil
+}
+
+// GoTimeout queues f, waiting at most d for room in the lane
+func (l *Lane) GoTimeout(f func(), d time.Duration) error {
+	return l.g.enqueue(l.l, task{f: f}, max(d, 0))
+}
+
+// Name returns the name of the lane
+func (l *Lane) Name() string {
+	return l.l.name
+}
+
+func (l *Lane) submit(t task) error {
+	return l.g.submitLane(l.l, t)
+}
+
+func (l *Lane) goPool() *GoPool {
+	return l.g
+}
+
+// LaneStats is a snapshot of the queue of a lane
+type LaneStats struct {
+	Name      string
+	Weight    int
+	Capacity  int
+	Queued    int
+	Submitted int64
+	Executed  int64
+	Dropped   int64
+	// OldestWait is how long the oldest queued function has been waiting
+	OldestWait time.Duration
+}
+
+type lane struct {
+	name      string
+	weight    int
+	credit    int
+	slots     chan struct{}
+	ring      ring
+	submitted int64
+	executed  int64
+	dropped   int64
+}
+
+// ring is a growable FIFO of tasks
+type ring struct {
+	buf  []task
+	head int
+	n    int
+}
+
+func (r *ring) push(t task) {
+	if r.n == len(r.buf) {
+		buf := make([]task, max(16, 2*len(r.buf)))
+		for i := 0; i < r.n; i++ {
+			buf[i] = r.buf[(r.head+i)%len(r.buf)]
+		}
+		r.buf, r.head = buf, 0
+	}
+	r.buf[(r.head+r.n)%len(r.buf)] = t
+	r.n++
+}
+
+func (r *ring) pop() (t task) {
+	t, r.buf[r.head] = r.buf[r.head], task{}
+	r.head = (r.head + 1) % len(r.buf)
+	r.n--
+	return
+}
+
+func (r *ring) peek() task {
+	return r.buf[r.head]
+}
+
+// lanes is the queue of a pool: a set of lanes served by weight, with aging against starvation
+type lanes struct {
+	mux   sync.Mutex
+	lanes []*lane // sorted by weight, highest first
+	n     int64
+	aging int64
+}
+
+func (q *lanes) add(name string, weight, size int) *lane {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	for _, l := range q.lanes {
+		if l.name == name {
+			return l
+		}
+	}
+	l := &lane{name: name, weight: max(weight, 1), slots: make(chan struct{}, size)}
+	l.credit = l.weight
+	q.lanes = append(q.lanes, l)
+	sort.SliceStable(q.lanes, func(i, j int) bool { return q.lanes[i].weight > q.lanes[j].weight })
+	return l
+}
+
+func (q *lanes) get(name string) *lane {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	for _, l := range q.lanes {
+		if l.name == name {
+			return l
+		}
+	}
+	return nil
+}
+
+func (q *lanes) push(l *lane, t task) {
+	q.mux.Lock()
+	l.ring.push(t)
+	q.mux.Unlock()
+	atomic.AddInt64(&q.n, 1)
+	atomic.AddInt64(&l.submitted, 1)
+}
+
+// pop takes the next task, the slot of its lane is released
+func (q *lanes) pop() (t task, ok bool) {
+	if atomic.LoadInt64(&q.n) == 0 {
+		return
+	}
+	q.mux.Lock()
+	l := q.next()
+	if l != nil {
+		t, ok = l.ring.pop(), true
+	}
+	q.mux.Unlock()
+	if ok {
+		atomic.AddInt64(&q.n, -1)
+		atomic.AddInt64(&l.executed, 1)
+		<-l.slots
+	}
+	return
+}
+
+// next selects the lane to serve, q.mux must be held
+func (q *lanes) next() *lane {
+	if len(q.lanes) == 1 {
+		if l := q.lanes[0]; l.ring.n > 0 {
+			return l
+		}
+		return nil
+	}
+	if aging := atomic.LoadInt64(&q.aging); aging > 0 {
+		// a function waiting longer than aging is served first, the longest waiting one wins
+		now, oldest := time.Now().UnixNano(), int64(0)
+		var aged *lane
+		for _, l := range q.lanes {
+			if l.ring.n > 0 {
+				if at := l.ring.peek().at; now-at >= aging && (aged == nil || at < oldest) {
+					aged, oldest = l, at
+				}
+			}
+		}
+		if aged != nil {
+			return aged
+		}
+	}
+	for pass := 0; pass < 2; pass++ {
+		for _, l := range q.lanes {
+			if l.ring.n > 0 && l.credit > 0 {
+				l.credit--
+				return l
+			}
+		}
+		// every lane with work has used its credit, start a new round
+		for _, l := range q.lanes {
+			l.credit = l.weight
+		}
+	}
+	return nil
+}
+
+// popLane takes the oldest task of l, the slot of the task is kept by the caller
+func (q *lanes) popLane(l *lane) (t task, ok bool) {
+	q.mux.Lock()
+	if ok = l.ring.n > 0; ok {
+		t = l.ring.pop()
+	}
+	q.mux.Unlock()
+	if ok {
+		atomic.AddInt64(&q.n, -1)
+		atomic.AddInt64(&l.dropped, 1)
+	}
+	return
+}
+
+// drain removes every queued task and releases their slots
+func (q *lanes) drain() (ts []task) {
+	q.mux.Lock()
+	for _, l := range q.lanes {
+		for l.ring.n > 0 {
+			ts = append(ts, l.ring.pop())
+			atomic.AddInt64(&l.dropped, 1)
+			<-l.slots
+		}
+	}
+	atomic.AddInt64(&q.n, -int64(len(ts)))
+	q.mux.Unlock()
+	return
+}
+
+func (q *lanes) len() int {
+	return int(atomic.LoadInt64(&q.n))
+}
+
+func (q *lanes) stats() (s []LaneStats) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	now := time.Now().UnixNano()
+	for _, l := range q.lanes {
+		ls := LaneStats{
+			Name:      l.name,
+			Weight:    l.weight,
+			Capacity:  cap(l.slots),
+			Queued:    l.ring.n,
+			Submitted: atomic.LoadInt64(&l.submitted),
+			Executed:  atomic.LoadInt64(&l.executed),
+			Dropped:   atomic.LoadInt64(&l.dropped),
+		}
+		if l.ring.n > 0 {
+			ls.OldestWait = time.Duration(now - l.ring.peek().at)
+		}
+		s = append(s, ls)
+	}
+	return
+}
+
+// AddLane adds a named lane with room for size queued functions, or returns the existing lane of that name
+func (g *GoPool) AddLane(name string, weight int, size int) *Lane {
+	return &Lane{g: g, l: g.queue.add(name, weight, size)}
+}
+
+// Lane returns the lane of that name, or nil
+func (g *GoPool) Lane(name string) *Lane {
+	if l := g.queue.get(name); l != nil {
+		return &Lane{g: g, l: l}
+	}
+	return nil
+}
+
+// SetAging sets how long a queued function may wait before it is served ahead of the lane weights, zero disables aging
+func (g *GoPool) SetAging(d time.Duration) {
+	atomic.StoreInt64(&g.queue.aging, int64(d))
+}
+
+// LaneStats returns the queue metrics of every lane
+func (g *GoPool) LaneStats() []LaneStats {
+	return g.queue.stats()
+}
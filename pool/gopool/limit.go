@@ -0,0 +1,63 @@
+// Copyright (c) 2023, donnie <donnie4w@gmail.com>
+// All rights reserved.
+// Use of t source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// github.com/donnie4w/gofer/pool/gopool
+
+package gopool
+
+import (
+	"sync"
+	"time"
+)
+
+// limiter is a token bucket
+type limiter struct {
+	mux    sync.Mutex
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// reserve takes a token and returns how long to wait until the token is available
+func (l *limiter) reserve() time.Duration {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	now := time.Now()
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// SetRateLimit limits the pool to perSecond function starts per second, allowing bursts of up to burst functions.
+// Workers wait for a token before they execute a function. A perSecond of zero or less removes the limit.
+func (g *GoPool) SetRateLimit(perSecond float64, burst int) {
+	if perSecond <= 0 {
+		g.limit.Store(nil)
+		return
+	}
+	burst = max(burst, 1)
+	g.limit.Store(&limiter{rate: perSecond, burst: float64(burst), tokens: float64(burst), last: time.Now()})
+}
+
+// throttle waits for a token of the rate limit, it returns early if the pool is shut down
+func (g *GoPool) throttle() {
+	l := g.limit.Load()
+	if l == nil {
+		return
+	}
+	if d := l.reserve(); d > 0 {
+		timer := time.NewTimer(d)
+		select {
+		case <-timer.C:
+		case <-g.ctx.Done():
+		}
+		timer.Stop()
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright (c) 2023, donnie <donnie4w@gmail.com>
+// All rights reserved.
+// Use of t source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// github.com/donnie4w/gofer/pool/gopool
+
+package gopool
+
+import (
+	"context"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BatchOption configures ParallelMap and ForEach
+type BatchOption func(*batchOptions)
+
+type batchOptions struct {
+	limit   int
+	retries int
+	backoff time.Duration
+}
+
+// WithConcurrency caps the number of items processed at the same time.
+// The default is the number of items, capped by the maximum number of workers of the pool.
+func WithConcurrency(n int) BatchOption {
+	return func(o *batchOptions) { o.limit = n }
+}
+
+// WithRetries retries a failed item up to n times, waiting backoff between the attempts
+func WithRetries(n int, backoff time.Duration) BatchOption {
+	return func(o *batchOptions) { o.retries, o.backoff = n, backoff }
+}
+
+// ParallelMap calls fn for every item on e and returns the results in the order of items.
+// The first error cancels the ctx passed to fn, stops the remaining items and is returned;
+// a panic of fn is returned as a *PanicError. The results of items not processed are zero values.
+func ParallelMap[T, R any](ctx context.Context, e Executor, items []T, fn func(ctx context.Context, item T) (R, error), opts ...BatchOption) ([]R, error) {
+	rs := make([]R, len(items))
+	err := ForEach(ctx, e, items, func(ctx context.Context, i int, item T) (err error) {
+		rs[i], err = fn(ctx, item)
+		return
+	}, opts...)
+	return rs, err
+}
+
+// ForEach calls fn with the index of every item on e and waits until all calls returned.
+// Cancellation, retries and panics are handled as in ParallelMap.
+func ForEach[T any](ctx context.Context, e Executor, items []T, fn func(ctx context.Context, i int, item T) error, opts ...BatchOption) error {
+	if len(items) == 0 {
+		return ctx.Err()
+	}
+	g := e.goPool()
+	o := batchOptions{limit: int(atomic.LoadInt64(&g.maxlimit))}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	o.limit = min(max(o.limit, 1), len(items))
+
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var once sync.Once
+	var first error
+	fail := func(err error) {
+		once.Do(func() {
+			first = err
+			cancel()
+		})
+	}
+
+	var wg sync.WaitGroup
+	var next int64 = -1
+	var processed int64
+	runner := func() {
+		defer wg.Done()
+		for ctx.Err() == nil {
+			i := int(atomic.AddInt64(&next, 1))
+			if i >= len(items) {
+				return
+			}
+			if err := attempt(ctx, g, o, func() error { return fn(ctx, i, items[i]) }); err != nil {
+				fail(err)
+			} else {
+				atomic.AddInt64(&processed, 1)
+			}
+		}
+	}
+	wg.Add(o.limit)
+	for i := 0; i < o.limit; i++ {
+		drop := func(err error) {
+			fail(err)
+			wg.Done()
+		}
+		if err := e.submit(task{f: runner, drop: drop, ctx: ctx}); err != nil {
+			drop(err)
+		}
+	}
+	wg.Wait()
+	if first == nil && processed < int64(len(items)) {
+		// the parent ctx was cancelled before every item was processed
+		return parent.Err()
+	}
+	return first
+}
+
+// attempt calls f, retrying as configured by o while ctx is not done
+func attempt(ctx context.Context, g *GoPool, o batchOptions, f func() error) (err error) {
+	for n := 0; ; n++ {
+		if err = protect(g, f); err == nil || n >= o.retries || ctx.Err() != nil {
+			return
+		}
+		if o.backoff > 0 {
+			timer := time.NewTimer(o.backoff)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			}
+		}
+	}
+}
+
+// protect calls f, a panic of f is reported to the panic handler of g and returned as a *PanicError
+func protect(g *GoPool, f func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			pe := &PanicError{Value: r, Stack: debug.Stack()}
+			g.onPanic(r, pe.Stack)
+			err = pe
+		}
+	}()
+	return f()
+}
@@ -7,8 +7,13 @@
 package gopool
 
 import (
+	"context"
 	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func Benchmark_gopool(b *testing.B) {
@@ -73,3 +78,607 @@ func BenchmarkParallel_gof(b *testing.B) {
 		}
 	})
 }
+
+func TestSubmit(t *testing.T) {
+	pool := NewPool(4, 8)
+	ctx := context.Background()
+	fs := make([]*Future[int], 100)
+	for i := range fs {
+		i := i
+		fs[i] = Submit(ctx, pool, func(ctx context.Context) (int, error) {
+			if i%10 == 0 {
+				return 0, fmt.Errorf("task %d", i)
+			}
+			return i * i, nil
+		})
+	}
+	for i, f := range fs {
+		v, err := f.Get(ctx)
+		if i%10 == 0 {
+			if err == nil {
+				t.Fatalf("task %d: expected error", i)
+			}
+		} else if err != nil || v != i*i {
+			t.Fatalf("task %d: %d %v", i, v, err)
+		}
+	}
+}
+
+func TestSubmitCancel(t *testing.T) {
+	pool := NewPool(1, 1)
+	block := make(chan struct{})
+	pool.Go(func() { <-block })
+	defer close(block)
+	ctx, cancel := context.WithCancel(context.Background())
+	ran := false
+	f := Submit(ctx, pool, func(ctx context.Context) (int, error) {
+		ran = true
+		return 1, nil
+	})
+	cancel()
+	if _, err := f.Get(context.Background()); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if ran {
+		t.Fatal("canceled task should not run")
+	}
+}
+
+func TestSubmitFullQueue(t *testing.T) {
+	pool := NewPoolWithFuncLimit(1, 1, 1)
+	block, started := make(chan struct{}), make(chan struct{})
+	defer close(block)
+	pool.Go(func() { close(started); <-block })
+	<-started
+	kp := NewKeyedPool(pool, 1)
+	kp.Go("a", func() { <-block })
+	for pool.TryGo(func() {}) || kp.TryGo("a", func() {}) {
+	}
+	for _, e := range []Executor{pool, kp.Key("a")} {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		fc := make(chan *Future[int], 1)
+		go func() { fc <- Submit(ctx, e, func(ctx context.Context) (int, error) { return 1, nil }) }()
+		var f *Future[int]
+		select {
+		case f = <-fc:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%T: Submit ignores ctx on a full queue", e)
+		}
+		if _, err := f.Get(context.Background()); err != context.DeadlineExceeded {
+			t.Fatalf("%T: expected context.DeadlineExceeded, got %v", e, err)
+		}
+		cancel()
+	}
+}
+
+func TestPanicHandler(t *testing.T) {
+	pool := NewPool(2, 2)
+	recovered := make(chan any, 2)
+	pool.SetPanicHandler(func(r any, stack []byte) {
+		if len(stack) == 0 {
+			t.Error("missing stack trace")
+		}
+		recovered <- r
+	})
+	pool.Go(func() { panic("go") })
+	f := Submit(context.Background(), pool, func(ctx context.Context) (int, error) { panic("submit") })
+	_, err := f.Get(context.Background())
+	if pe, ok := err.(*PanicError); !ok || pe.Value != "submit" {
+		t.Fatalf("expected PanicError, got %v", err)
+	}
+	got := map[any]bool{<-recovered: true, <-recovered: true}
+	if !got["go"] || !got["submit"] {
+		t.Fatalf("unexpected panics %v", got)
+	}
+}
+
+func TestSetPanicHandlerRunning(t *testing.T) {
+	pool := NewPool(4, 4)
+	var n int64
+	h := func(r any, stack []byte) { atomic.AddInt64(&n, 1) }
+	pool.SetPanicHandler(h)
+	done := make(chan struct{})
+	go func() {
+		// the handler is replaced while workers call it
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			pool.SetPanicHandler(h)
+			time.Sleep(100 * time.Microsecond)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		pool.Go(func() { time.Sleep(100 * time.Microsecond); panic(i) })
+	}
+	<-done
+	pool.Wait()
+	if atomic.LoadInt64(&n) != 100 {
+		t.Fatalf("%d panics handled", n)
+	}
+	pool.SetPanicHandler(nil)
+	pool.Go(func() { panic("no handler") })
+	pool.Wait()
+	if atomic.LoadInt64(&n) != 100 || pool.Stats().Panicked != 101 {
+		t.Fatalf("%d panics handled, %d recovered", n, pool.Stats().Panicked)
+	}
+}
+
+func TestWait(t *testing.T) {
+	pool := NewPool(2, 8)
+	var n int64
+	for i := 0; i < 1000; i++ {
+		pool.Go(func() {
+			time.Sleep(time.Microsecond)
+			atomic.AddInt64(&n, 1)
+		})
+	}
+	pool.Wait()
+	if n != 1000 {
+		t.Fatalf("Wait returned with %d of 1000 done", n)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	pool := NewPool(1, 1)
+	var n int64
+	for i := 0; i < 10; i++ {
+		pool.Go(func() { atomic.AddInt64(&n, 1) })
+	}
+	if abandoned, err := pool.Shutdown(context.Background()); abandoned != 0 || err != nil || n != 10 {
+		t.Fatalf("graceful shutdown: %d %v %d", abandoned, err, n)
+	}
+	if f := Submit(context.Background(), pool, func(ctx context.Context) (int, error) { return 1, nil }); f != nil {
+		if _, err := f.Get(context.Background()); err != ErrPoolClosed {
+			t.Fatalf("expected ErrPoolClosed, got %v", err)
+		}
+	}
+
+	pool = NewPool(1, 1)
+	block := make(chan struct{})
+	pool.Go(func() { <-block })
+	f := Submit(context.Background(), pool, func(ctx context.Context) (int, error) { return 1, nil })
+	for i := 0; i < 4; i++ {
+		pool.Go(func() {})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	abandoned, err := pool.Shutdown(ctx)
+	close(block)
+	if abandoned != 5 || err != context.DeadlineExceeded {
+		t.Fatalf("shutdown after deadline: %d %v", abandoned, err)
+	}
+	if _, err := f.Get(context.Background()); err != ErrPoolClosed {
+		t.Fatalf("expected ErrPoolClosed, got %v", err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	pool := NewPool(1, 1)
+	block := make(chan struct{})
+	pool.Go(func() { <-block })
+	var n int64
+	for i := 0; i < 10; i++ {
+		pool.Go(func() { atomic.AddInt64(&n, 1) })
+	}
+	pool.Close()
+	close(block)
+	pool.Go(func() { atomic.AddInt64(&n, 1) })
+	for i := 0; i < 100 && atomic.LoadInt64(&n) < 11; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n != 11 {
+		t.Fatalf("queued functions lost on Close: %d", n)
+	}
+}
+
+func TestTryGoAndGoTimeout(t *testing.T) {
+	pool := NewPoolWithFuncLimit(1, 1, 1)
+	block := make(chan struct{})
+	started := make(chan struct{})
+	pool.Go(func() { close(started); <-block })
+	<-started
+	if !pool.TryGo(func() {}) {
+		t.Fatal("TryGo should queue into the empty queue")
+	}
+	if pool.TryGo(func() {}) {
+		t.Fatal("TryGo should fail on a full queue")
+	}
+	if err := pool.GoTimeout(func() {}, 20*time.Millisecond); err != ErrPoolFull {
+		t.Fatalf("expected ErrPoolFull, got %v", err)
+	}
+	close(block)
+	if err := pool.GoTimeout(func() {}, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	pool.Wait()
+}
+
+func TestOverflowPolicy(t *testing.T) {
+	newBlocked := func(p OverflowPolicy) (*GoPool, chan struct{}) {
+		pool := NewPoolWithFuncLimit(1, 1, 2)
+		pool.SetOverflowPolicy(p)
+		block, started := make(chan struct{}), make(chan struct{})
+		pool.Go(func() { close(started); <-block })
+		<-started
+		return pool, block
+	}
+
+	pool, block := newBlocked(OverflowReject)
+	var n int64
+	for i := 0; i < 5; i++ {
+		pool.Go(func() { atomic.AddInt64(&n, 1) })
+	}
+	f := Submit(context.Background(), pool, func(ctx context.Context) (int, error) { return 1, nil })
+	if _, err := f.Get(context.Background()); err != ErrPoolFull {
+		t.Fatalf("expected ErrPoolFull, got %v", err)
+	}
+	close(block)
+	pool.Wait()
+	if n != 2 {
+		t.Fatalf("reject: %d functions executed", n)
+	}
+
+	pool, block = newBlocked(OverflowCallerRuns)
+	ran := false
+	pool.Go(func() {})
+	pool.Go(func() {})
+	pool.Go(func() { ran = true })
+	if !ran {
+		t.Fatal("caller runs: function not executed by the caller")
+	}
+	close(block)
+
+	pool, block = newBlocked(OverflowDropOldest)
+	var order []int
+	fs := []*Future[int]{}
+	for i := 0; i < 4; i++ {
+		i := i
+		fs = append(fs, Submit(context.Background(), pool, func(ctx context.Context) (int, error) {
+			order = append(order, i)
+			return i, nil
+		}))
+	}
+	close(block)
+	for i, f := range fs {
+		if _, err := f.Get(context.Background()); (i < 2) != (err == ErrPoolFull) {
+			t.Fatalf("drop oldest: future %d: %v", i, err)
+		}
+	}
+	if fmt.Sprint(order) != "[2 3]" {
+		t.Fatalf("drop oldest: executed %v", order)
+	}
+}
+
+func TestDropOldestConcurrent(t *testing.T) {
+	pool := NewPoolWithFuncLimit(1, 1, 1)
+	pool.SetOverflowPolicy(OverflowDropOldest)
+	var n int64
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				pool.Go(func() { atomic.AddInt64(&n, 1) })
+			}
+		}()
+	}
+	wg.Wait()
+	pool.Wait()
+	if got := atomic.LoadInt64(&n) + pool.Stats().Rejected; got != 8000 {
+		t.Fatalf("%d functions executed or dropped", got)
+	}
+}
+
+func TestLanes(t *testing.T) {
+	pool := NewPoolWithFuncLimit(1, 1, 16)
+	high := pool.AddLane("high", 3, 16)
+	low := pool.AddLane("low", 1, 16)
+	if pool.Lane("high") == nil || pool.Lane("none") != nil {
+		t.Fatal("Lane lookup failed")
+	}
+	block, started := make(chan struct{}), make(chan struct{})
+	pool.Go(func() { close(started); <-block })
+	<-started
+	var order []string
+	for i := 0; i < 4; i++ {
+		low.Go(func() { order = append(order, "l") })
+		high.Go(func() { order = append(order, "h") })
+	}
+	f := Submit(context.Background(), high, func(ctx context.Context) (string, error) { return "h", nil })
+	for _, s := range pool.LaneStats() {
+		if s.Name == "high" && (s.Queued != 5 || s.Weight != 3 || s.Capacity != 16) {
+			t.Fatalf("stats: %+v", s)
+		}
+	}
+	close(block)
+	if v, err := f.Get(context.Background()); v != "h" || err != nil {
+		t.Fatal(v, err)
+	}
+	pool.Wait()
+	if s := strings.Join(order, ""); s != "hhhlhlll" {
+		t.Fatalf("lane order %s", s)
+	}
+	for _, s := range pool.LaneStats() {
+		if s.Queued != 0 || s.Submitted != s.Executed {
+			t.Fatalf("stats: %+v", s)
+		}
+	}
+}
+
+func TestLaneAging(t *testing.T) {
+	pool := NewPoolWithFuncLimit(1, 1, 16)
+	pool.SetAging(20 * time.Millisecond)
+	high := pool.AddLane("high", 100, 16)
+	block, started := make(chan struct{}), make(chan struct{})
+	pool.Go(func() { close(started); <-block })
+	<-started
+	var order []string
+	pool.Go(func() { order = append(order, "l") })
+	time.Sleep(30 * time.Millisecond)
+	high.Go(func() { order = append(order, "h") })
+	close(block)
+	pool.Wait()
+	if s := strings.Join(order, ""); s != "lh" {
+		t.Fatalf("aged function not served first: %s", s)
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	for i := 0; i < 200; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("condition not reached")
+}
+
+func TestKeepAlive(t *testing.T) {
+	pool := NewPool(1, 4)
+	pool.SetKeepAlive(50 * time.Millisecond)
+	block := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		pool.Go(func() { <-block })
+	}
+	waitFor(t, func() bool { return pool.Stats().Running == 4 })
+	close(block)
+	waitFor(t, func() bool { return pool.Stats().Idle == 4 })
+	waitFor(t, func() bool { s := pool.Stats(); return s.Running == 1 && s.Idle == 1 })
+}
+
+func TestSetLimits(t *testing.T) {
+	pool := NewPool(1, 1)
+	block := make(chan struct{})
+	var n int64
+	for i := 0; i < 4; i++ {
+		pool.Go(func() { atomic.AddInt64(&n, 1); <-block })
+	}
+	waitFor(t, func() bool { return atomic.LoadInt64(&n) == 1 })
+	pool.SetLimits(2, 4)
+	waitFor(t, func() bool { return atomic.LoadInt64(&n) == 4 })
+	if s := pool.Stats(); s.Running != 4 || s.Queued != 0 {
+		t.Fatalf("stats after raising the limits: %+v", s)
+	}
+	pool.SetLimits(1, 1)
+	close(block)
+	pool.Wait()
+	waitFor(t, func() bool { return pool.Stats().Running == 1 })
+}
+
+func TestStats(t *testing.T) {
+	pool := NewPool(2, 2)
+	pool.SetPanicHandler(func(any, []byte) {})
+	for i := 0; i < 10; i++ {
+		pool.Go(func() {})
+	}
+	pool.Go(func() { panic("boom") })
+	Submit(context.Background(), pool, func(ctx context.Context) (int, error) { panic("boom") }).Get(context.Background())
+	pool.Wait()
+	if s := pool.Stats(); s.Executed != 12 || s.Panicked != 2 || s.Queued != 0 || s.Running > 2 {
+		t.Fatalf("stats: %+v", s)
+	}
+}
+
+func TestKeyedPool(t *testing.T) {
+	pool := NewPool(8, 8)
+	kp := NewKeyedPool(pool, 1<<10)
+	var mux sync.Mutex
+	got := map[string][]int{}
+	var active [4]int32
+	for i := 0; i < 400; i++ {
+		k := i % 4
+		key := fmt.Sprint("user", k)
+		kp.Go(key, func() {
+			if atomic.AddInt32(&active[k], 1) != 1 {
+				t.Error("functions of one key ran in parallel")
+			}
+			mux.Lock()
+			got[key] = append(got[key], i)
+			mux.Unlock()
+			atomic.AddInt32(&active[k], -1)
+		})
+	}
+	f := Submit(context.Background(), kp.Key("user1"), func(ctx context.Context) (int, error) {
+		mux.Lock()
+		defer mux.Unlock()
+		return len(got["user1"]), nil
+	})
+	if n, err := f.Get(context.Background()); n != 100 || err != nil {
+		t.Fatalf("future after 100 functions of the key: %d %v", n, err)
+	}
+	pool.Wait()
+	for key, is := range got {
+		for j := 1; j < len(is); j++ {
+			if is[j] < is[j-1] {
+				t.Fatalf("%s out of order: %v", key, is)
+			}
+		}
+	}
+	if n := kp.Keys(); n != 0 {
+		t.Fatalf("%d idle key queues left", n)
+	}
+}
+
+func TestKeyedPoolBounded(t *testing.T) {
+	pool := NewPool(2, 2)
+	kp := NewKeyedPool(pool, 2)
+	block, started := make(chan struct{}), make(chan struct{})
+	kp.Go("a", func() { close(started); <-block })
+	<-started
+	if !kp.TryGo("a", func() {}) || !kp.TryGo("a", func() {}) {
+		t.Fatal("TryGo should queue into the queue of the key")
+	}
+	if kp.TryGo("a", func() {}) {
+		t.Fatal("TryGo should fail on the full queue of the key")
+	}
+	if err := kp.GoTimeout("a", func() {}, 10*time.Millisecond); err != ErrPoolFull {
+		t.Fatalf("expected ErrPoolFull, got %v", err)
+	}
+	if !kp.TryGo("b", func() {}) {
+		t.Fatal("another key should not be affected")
+	}
+	close(block)
+	pool.Wait()
+	if n := kp.Keys(); n != 0 {
+		t.Fatalf("%d idle key queues left", n)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	pool := NewPool(4, 4)
+	pool.SetRateLimit(100, 5)
+	start := time.Now()
+	for i := 0; i < 25; i++ {
+		pool.Go(func() {})
+	}
+	pool.Wait()
+	// 5 functions start at once, the other 20 at 100 per second
+	if d := time.Since(start); d < 150*time.Millisecond || d > time.Second {
+		t.Fatalf("25 functions took %v", d)
+	}
+	pool.SetRateLimit(0, 0)
+	start = time.Now()
+	for i := 0; i < 100; i++ {
+		pool.Go(func() {})
+	}
+	pool.Wait()
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Fatalf("unlimited pool took %v", d)
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	pool := NewPool(2, 2)
+	var order []int
+	var mux sync.Mutex
+	add := func(i int) func() {
+		return func() { mux.Lock(); order = append(order, i); mux.Unlock() }
+	}
+	pool.Schedule(40*time.Millisecond, add(2))
+	pool.Schedule(10*time.Millisecond, add(1))
+	j := pool.Schedule(20*time.Millisecond, add(3))
+	if !j.Cancel() || j.Cancel() {
+		t.Fatal("Cancel should succeed once")
+	}
+	var n int64
+	every := pool.Every(10*time.Millisecond, func() { atomic.AddInt64(&n, 1) })
+	time.Sleep(100 * time.Millisecond)
+	if !every.Cancel() {
+		t.Fatal("Cancel of a periodic job failed")
+	}
+	pool.Wait()
+	mux.Lock()
+	if fmt.Sprint(order) != "[1 2]" {
+		t.Fatalf("scheduled order %v", order)
+	}
+	mux.Unlock()
+	c := atomic.LoadInt64(&n)
+	if c < 3 || c > 11 {
+		t.Fatalf("periodic job ran %d times", c)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if atomic.LoadInt64(&n) != c {
+		t.Fatal("periodic job ran after Cancel")
+	}
+	pool.Shutdown(context.Background())
+	if j := pool.Schedule(time.Millisecond, func() {}); j.Cancel() {
+		t.Fatal("job scheduled after Shutdown")
+	}
+}
+
+func TestParallelMap(t *testing.T) {
+	pool := NewPool(4, 4)
+	items := make([]int, 100)
+	for i := range items {
+		items[i] = i
+	}
+	var active, peak int32
+	rs, err := ParallelMap(context.Background(), pool, items, func(ctx context.Context, i int) (string, error) {
+		n := atomic.AddInt32(&active, 1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		atomic.AddInt32(&active, -1)
+		return fmt.Sprint(i), nil
+	}, WithConcurrency(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range rs {
+		if r != fmt.Sprint(i) {
+			t.Fatalf("result %d is %s", i, r)
+		}
+	}
+	if peak > 2 {
+		t.Fatalf("%d items processed at the same time", peak)
+	}
+}
+
+func TestForEachError(t *testing.T) {
+	pool := NewPool(4, 4)
+	items := make([]int, 1000)
+	boom := fmt.Errorf("boom")
+	var calls int64
+	err := ForEach(context.Background(), pool, items, func(ctx context.Context, i int, _ int) error {
+		atomic.AddInt64(&calls, 1)
+		if i == 10 {
+			return boom
+		}
+		time.Sleep(time.Millisecond)
+		return ctx.Err()
+	})
+	if err != boom {
+		t.Fatalf("expected the first error, got %v", err)
+	}
+	if calls > 100 {
+		t.Fatalf("%d items processed after the error", calls)
+	}
+
+	var attempts int64
+	err = ForEach(context.Background(), pool, []int{1}, func(ctx context.Context, i int, _ int) error {
+		if atomic.AddInt64(&attempts, 1) < 3 {
+			return boom
+		}
+		return nil
+	}, WithRetries(2, time.Millisecond))
+	if err != nil || attempts != 3 {
+		t.Fatalf("retries: %v after %d attempts", err, attempts)
+	}
+
+	pool.SetPanicHandler(func(any, []byte) {})
+	_, err = ParallelMap(context.Background(), pool, []int{1}, func(ctx context.Context, i int) (int, error) { panic("boom") })
+	if _, ok := err.(*PanicError); !ok {
+		t.Fatalf("expected a PanicError, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := ForEach(ctx, pool, items, func(ctx context.Context, i int, _ int) error { return nil }); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright (c) 2023, donnie <donnie4w@gmail.com>
+// All rights reserved.
+// Use of t source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// github.com/donnie4w/gofer/pool/gopool
+
+package gopool
+
+import (
+	"container/heap"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Job is a function scheduled with Schedule or Every
+type Job struct {
+	f        func()
+	at       int64 // next run in unix nanoseconds
+	every    int64 // interval of a periodic job in nanoseconds
+	index    int   // position in the heap, -1 if not scheduled
+	running  int32 // a run of a periodic job has not finished yet
+	canceled bool
+	g        *GoPool
+}
+
+// Cancel stops the job, it reports whether the job was still scheduled.
+// A run already handed to the pool is not interrupted.
+func (j *Job) Cancel() bool {
+	s := &j.g.sched
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if j.canceled || j.index < 0 {
+		return false
+	}
+	j.canceled = true
+	heap.Remove(&s.jobs, j.index)
+	return true
+}
+
+// scheduler keeps the jobs of a pool in a heap ordered by their next run, served by a single goroutine
+type scheduler struct {
+	mux     sync.Mutex
+	jobs    jobHeap
+	wake    chan struct{}
+	started bool
+}
+
+type jobHeap []*Job
+
+func (h jobHeap) Len() int           { return len(h) }
+func (h jobHeap) Less(i, j int) bool { return h[i].at < h[j].at }
+func (h jobHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+func (h *jobHeap) Push(x any) {
+	j := x.(*Job)
+	j.index = len(*h)
+	*h = append(*h, j)
+}
+func (h *jobHeap) Pop() any {
+	old := *h
+	j := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	j.index = -1
+	return j
+}
+
+// Schedule executes f on the pool once d has elapsed
+func (g *GoPool) Schedule(d time.Duration, f func()) *Job {
+	return g.addJob(&Job{f: f, at: time.Now().Add(d).UnixNano(), index: -1, g: g})
+}
+
+// Every executes f on the pool every interval, starting one interval from now.
+// A run is skipped while the previous run has not finished.
+func (g *GoPool) Every(interval time.Duration, f func()) *Job {
+	interval = max(interval, time.Millisecond)
+	return g.addJob(&Job{f: f, at: time.Now().Add(interval).UnixNano(), every: int64(interval), index: -1, g: g})
+}
+
+func (g *GoPool) addJob(j *Job) *Job {
+	s := &g.sched
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if atomic.LoadInt32(&g.stopped) == 1 || g.ctx.Err() != nil {
+		j.canceled = true
+		return j
+	}
+	heap.Push(&s.jobs, j)
+	if !s.started {
+		s.started = true
+		s.wake = make(chan struct{}, 1)
+		go g.runScheduler()
+	} else if j.index == 0 {
+		// the new job is due before the one the scheduler waits for
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	}
+	return j
+}
+
+func (g *GoPool) runScheduler() {
+	s := &g.sched
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	var due []*Job
+	for {
+		s.mux.Lock()
+		now := time.Now().UnixNano()
+		for len(s.jobs) > 0 && s.jobs[0].at <= now {
+			j := s.jobs[0]
+			due = append(due, j)
+			if j.every > 0 {
+				// a periodic job keeps its rate but does not catch up on runs it missed
+				j.at = max(j.at+j.every, now)
+				heap.Fix(&s.jobs, 0)
+			} else {
+				heap.Pop(&s.jobs)
+			}
+		}
+		wait := time.Hour
+		if len(s.jobs) > 0 {
+			wait = time.Duration(s.jobs[0].at - now)
+		}
+		s.mux.Unlock()
+
+		for i, j := range due {
+			g.fire(j)
+			due[i] = nil
+		}
+		due = due[:0]
+
+		timer.Reset(wait)
+		select {
+		case <-timer.C:
+		case <-s.wake:
+		case <-g.ctx.Done():
+			return
+		}
+	}
+}
+
+// fire hands a run of j to the pool, subject to the overflow policy and the rate limit
+func (g *GoPool) fire(j *Job) {
+	if j.every == 0 {
+		g.submitLane(g.deflane, task{f: j.f})
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&j.running, 0, 1) {
+		return
+	}
+	done := func(error) { atomic.StoreInt32(&j.running, 0) }
+	if err := g.submitLane(g.deflane, task{f: func() { defer done(nil); j.f() }, drop: done}); err != nil {
+		done(err)
+	}
+}
@@ -33,6 +33,9 @@ func TestZlib(t *testing.T) {
 	bs, err = UnZlib(bs)
 	fmt.Println(err)
 	fmt.Println(string(bs))
+	if !bytes.Equal(bs, in) {
+		t.Fatal("zlib round trip")
+	}
 }
 
 func Benchmark_md5(b *testing.B) {
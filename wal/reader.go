@@ -0,0 +1,179 @@
+// Copyright (c) 2023, donnie <donnie4w@gmail.com>
+// All rights reserved.
+// Use of t source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// github.com/donnie4w/gofer/wal
+
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sort"
+)
+
+var errTorn = errors.New("wal: torn record")
+
+// readRecord reads one record into buf. A record cut short by the end of r or failing its
+// checksum returns errTorn, the end of r before a record returns io.EOF.
+func readRecord(r *bufio.Reader, buf []byte) (data []byte, err error) {
+	var hdr [headerSize]byte
+	if _, err = io.ReadFull(r, hdr[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = errTorn
+		}
+		return
+	}
+	n := binary.BigEndian.Uint32(hdr[:])
+	if n > maxRecordSize {
+		return nil, errTorn
+	}
+	if cap(buf) < int(n) {
+		buf = make([]byte, n)
+	}
+	data = buf[:n]
+	if _, err = io.ReadFull(r, data); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = errTorn
+		}
+		return
+	}
+	if checksum(hdr[:], data) != binary.BigEndian.Uint32(hdr[4:]) {
+		return nil, errTorn
+	}
+	return
+}
+
+// validEnd returns the end of the last complete record of the segment file at path, zero if it does not exist
+func validEnd(path string) (end int64, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	defer f.Close()
+	r := bufio.NewReaderSize(f, 1<<16)
+	var buf []byte
+	for {
+		var data []byte
+		if data, err = readRecord(r, buf); err != nil {
+			if err == io.EOF || err == errTorn {
+				err = nil
+			}
+			return
+		}
+		buf = data
+		end += int64(headerSize + len(data))
+	}
+}
+
+// Iterator replays the records of a Log in order
+type Iterator struct {
+	l      *Log
+	bases  []int64
+	seg    int // index of the current segment in bases
+	f      *os.File
+	r      *bufio.Reader
+	offset int64 // offset of the next record
+	cur    int64 // offset of the current record
+	data   []byte
+	err    error
+}
+
+// Iterator returns an Iterator over the records from offset, which must be the offset of a record
+// or the offset of the next record. Records written after the call may or may not be returned.
+func (l *Log) Iterator(offset int64) (*Iterator, error) {
+	l.mu.RLock()
+	bases := append([]int64(nil), l.bases...)
+	end := l.active.base + l.active.size
+	l.mu.RUnlock()
+	if offset < bases[0] || offset > end {
+		return nil, ErrOffset
+	}
+	i := sort.Search(len(bases), func(i int) bool { return bases[i] > offset }) - 1
+	return &Iterator{l: l, bases: bases, seg: i, offset: offset}, nil
+}
+
+// Next advances to the next record, it returns false at the end of the log or on an error
+func (it *Iterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	for {
+		if it.r == nil {
+			if it.seg >= len(it.bases) {
+				return false
+			}
+			if it.err = it.open(); it.err != nil {
+				return false
+			}
+		}
+		data, err := readRecord(it.r, it.data)
+		last := it.seg == len(it.bases)-1
+		switch {
+		case err == nil:
+			it.data, it.cur = data, it.offset
+			it.offset += int64(headerSize + len(data))
+			return true
+		case err == io.EOF && !last:
+			it.f.Close()
+			it.f, it.r = nil, nil
+			it.seg++
+		case err == io.EOF || (err == errTorn && last):
+			// the end of the log, or a record still being written
+			return false
+		case err == errTorn:
+			it.err = ErrCorrupt
+			return false
+		default:
+			it.err = err
+			return false
+		}
+	}
+}
+
+func (it *Iterator) open() (err error) {
+	base := it.bases[it.seg]
+	if it.f, err = os.Open(it.l.segmentPath(base)); err != nil {
+		return
+	}
+	if it.offset < base {
+		it.offset = base
+	}
+	if _, err = it.f.Seek(it.offset-base, io.SeekStart); err != nil {
+		return
+	}
+	it.r = bufio.NewReaderSize(it.f, 1<<16)
+	return
+}
+
+// Record returns the current record, it is valid until the next call to Next
+func (it *Iterator) Record() []byte {
+	return it.data
+}
+
+// Offset returns the offset of the current record
+func (it *Iterator) Offset() int64 {
+	return it.cur
+}
+
+// Err returns the error that stopped the iteration, nil at the end of the log
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Close releases the file of the iterator
+func (it *Iterator) Close() error {
+	if it.f != nil {
+		f := it.f
+		it.f, it.r = nil, nil
+		return f.Close()
+	}
+	return nil
+}
@@ -0,0 +1,16 @@
+// Copyright (c) 2023, donnie <donnie4w@gmail.com>
+// All rights reserved.
+// Use of t source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// github.com/donnie4w/gofer/wal
+
+//go:build windows
+// +build windows
+
+package wal
+
+// syncDir is a no-op, a directory cannot be flushed on Windows and NTFS journals its entries
+func syncDir(dir string) error {
+	return nil
+}
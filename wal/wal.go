@@ -0,0 +1,412 @@
+// Copyright (c) 2023, donnie <donnie4w@gmail.com>
+// All rights reserved.
+// Use of t source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// github.com/donnie4w/gofer/wal
+
+// Package wal is an append-only write-ahead log on top of fastio.
+//
+// Records are framed with a 4 byte length and the CRC32 of the length and the payload and appended to
+// segment files named after the log offset of their first byte. The offset of a record is
+// its position in the log and stays valid across segments and restarts.
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/donnie4w/gofer/fastio"
+)
+
+var (
+	ErrClosed   = errors.New("wal: log is closed")
+	ErrTooLarge = errors.New("wal: record too large")
+	ErrCorrupt  = errors.New("wal: corrupt record")
+	ErrOffset   = errors.New("wal: offset out of range")
+)
+
+// SyncPolicy determines when written records are flushed to stable storage
+type SyncPolicy int
+
+const (
+	// SyncAlways fsyncs before Write returns, concurrent writers share one fsync
+	SyncAlways SyncPolicy = iota
+	// SyncGroup fsyncs every SyncInterval, Write returns after the next fsync
+	SyncGroup
+	// SyncOS leaves flushing to the operating system, Write returns once the record is written
+	SyncOS
+)
+
+const (
+	headerSize         = 8
+	maxRecordSize      = 1 << 30
+	segmentExt         = ".wal"
+	defaultSegmentSize = 64 << 20
+	defaultInterval    = 10 * time.Millisecond
+)
+
+// Options configures a Log
+type Options struct {
+	// SegmentSize is the size at which the log rolls into a new segment file, the default is 64MB
+	SegmentSize int64
+	// Sync is the fsync policy, the default is SyncAlways
+	Sync SyncPolicy
+	// SyncInterval is the group commit interval of SyncGroup, the default is 10ms
+	SyncInterval time.Duration
+}
+
+// Log is a segmented write-ahead log, it is safe for concurrent use
+type Log struct {
+	dir    string
+	opts   Options
+	mu     sync.RWMutex // writers hold the read lock, rolling a segment and Close hold the write lock
+	bases  []int64      // base offsets of the segments, ascending
+	active *segment
+	closed bool
+	err    atomic.Pointer[error] // first write or sync error, the log refuses writes after it
+	group  *group
+}
+
+type segment struct {
+	base    int64
+	f       *os.File
+	w       fastio.File
+	size    int64 // bytes reserved by writers
+	written int64 // end of the bytes written
+	smux    sync.Mutex
+	synced  int64 // end of the bytes on stable storage, guarded by smux
+}
+
+// Open opens the log in dir, creating dir if necessary. A torn record at the end of the
+// last segment, left by a crash during a write, is truncated.
+func Open(dir string, opts *Options) (l *Log, err error) {
+	l = &Log{dir: dir}
+	if opts != nil {
+		l.opts = *opts
+	}
+	if l.opts.SegmentSize <= 0 {
+		l.opts.SegmentSize = defaultSegmentSize
+	}
+	if l.opts.SyncInterval <= 0 {
+		l.opts.SyncInterval = defaultInterval
+	}
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if l.bases, err = listSegments(dir); err != nil {
+		return nil, err
+	}
+	if len(l.bases) == 0 {
+		l.bases = []int64{0}
+	}
+	base := l.bases[len(l.bases)-1]
+	end, err := validEnd(l.segmentPath(base))
+	if err != nil {
+		return nil, err
+	}
+	if l.active, err = l.openSegment(base, end); err != nil {
+		return nil, err
+	}
+	if l.opts.Sync == SyncGroup {
+		l.group = newGroup(l)
+	}
+	return l, nil
+}
+
+// checksum returns the CRC32 of the length in hdr and of data. The length is covered so that a
+// zero-filled tail, which a crash may leave, never reads as a valid empty record.
+func checksum(hdr, data []byte) uint32 {
+	return crc32.Update(crc32.ChecksumIEEE(hdr[:4]), crc32.IEEETable, data)
+}
+
+func listSegments(dir string) (bases []int64, err error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		if base, err := strconv.ParseInt(strings.TrimSuffix(name, segmentExt), 10, 64); err == nil {
+			bases = append(bases, base)
+		}
+	}
+	sort.Slice(bases, func(i, j int) bool { return bases[i] < bases[j] })
+	return
+}
+
+func (l *Log) segmentPath(base int64) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%020d%s", base, segmentExt))
+}
+
+// openSegment opens the segment at base for appending, the file is truncated to size. Unless the
+// policy is SyncOS, the directory is synced so that the entry of a new segment survives a crash.
+func (l *Log) openSegment(base, size int64) (s *segment, err error) {
+	f, err := os.OpenFile(l.segmentPath(base), os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if l.opts.Sync != SyncOS {
+		if err = syncDir(l.dir); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if fi, err := f.Stat(); err != nil || fi.Size() != size {
+		if err == nil {
+			err = f.Truncate(size)
+		}
+		if err == nil && l.opts.Sync != SyncOS {
+			err = f.Sync()
+		}
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	w, err := fastio.New(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &segment{base: base, f: f, w: w, size: size, written: size, synced: size}, nil
+}
+
+// Write appends data as one record and returns its offset. It returns according to the sync policy.
+func (l *Log) Write(data []byte) (offset int64, err error) {
+	if len(data) > maxRecordSize {
+		return 0, ErrTooLarge
+	}
+	frame := make([]byte, headerSize+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	binary.BigEndian.PutUint32(frame[4:], checksum(frame, data))
+	copy(frame[headerSize:], data)
+	n := int64(len(frame))
+
+	l.mu.RLock()
+	for {
+		if l.closed {
+			l.mu.RUnlock()
+			return 0, ErrClosed
+		}
+		if err = l.failed(); err != nil {
+			l.mu.RUnlock()
+			return
+		}
+		s := l.active
+		size := atomic.LoadInt64(&s.size)
+		if size > 0 && size+n > l.opts.SegmentSize {
+			l.mu.RUnlock()
+			if err = l.roll(s); err != nil {
+				return
+			}
+			l.mu.RLock()
+			continue
+		}
+		if !atomic.CompareAndSwapInt64(&s.size, size, size+n) {
+			continue
+		}
+		var off int64
+		if off, err = s.w.WriteSync(frame); err != nil {
+			// the segment may hold a partial record now
+			l.mu.RUnlock()
+			return 0, l.fail(err)
+		}
+		end := off + n
+		for {
+			w := atomic.LoadInt64(&s.written)
+			if w >= end || atomic.CompareAndSwapInt64(&s.written, w, end) {
+				break
+			}
+		}
+		offset = s.base + off
+		if l.opts.Sync == SyncAlways {
+			err = l.sync(s, end)
+		}
+		l.mu.RUnlock()
+		if l.opts.Sync == SyncGroup {
+			err = l.group.wait()
+		}
+		return
+	}
+}
+
+// roll seals s and starts a new segment after it, unless another writer did already
+func (l *Log) roll(s *segment) (err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed || l.active != s {
+		return
+	}
+	if err = l.seal(s); err != nil {
+		return l.fail(err)
+	}
+	base := s.base + s.size
+	next, err := l.openSegment(base, 0)
+	if err != nil {
+		return l.fail(err)
+	}
+	l.active = next
+	l.bases = append(l.bases, base)
+	return
+}
+
+// seal syncs and closes a segment that receives no more writes
+func (l *Log) seal(s *segment) (err error) {
+	if l.opts.Sync != SyncOS {
+		if err = l.sync(s, s.written); err != nil {
+			return
+		}
+	}
+	return s.w.Close()
+}
+
+// sync makes the bytes of s up to end durable, concurrent callers share one fsync
+func (l *Log) sync(s *segment, end int64) (err error) {
+	s.smux.Lock()
+	defer s.smux.Unlock()
+	if s.synced >= end {
+		return l.failed()
+	}
+	written := atomic.LoadInt64(&s.written)
+	if err = s.f.Sync(); err != nil {
+		return l.fail(err)
+	}
+	s.synced = written
+	return
+}
+
+// fail records the first write or sync error; the data of a failed fsync may be lost, so the log stops accepting writes
+func (l *Log) fail(err error) error {
+	l.err.CompareAndSwap(nil, &err)
+	return *l.err.Load()
+}
+
+func (l *Log) failed() error {
+	if p := l.err.Load(); p != nil {
+		return *p
+	}
+	return nil
+}
+
+// Sync makes every record written so far durable
+func (l *Log) Sync() error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return ErrClosed
+	}
+	return l.sync(l.active, atomic.LoadInt64(&l.active.written))
+}
+
+// Offset returns the offset of the next record
+func (l *Log) Offset() int64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.active.base + atomic.LoadInt64(&l.active.size)
+}
+
+// Close syncs the log, unless the policy is SyncOS, and closes it
+func (l *Log) Close() (err error) {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return ErrClosed
+	}
+	l.closed = true
+	if err = l.seal(l.active); err != nil {
+		l.fail(err)
+	}
+	l.mu.Unlock()
+	if l.group != nil {
+		l.group.stop()
+	}
+	return
+}
+
+// group is the group commit of SyncGroup: writers wait for the batch that the next tick syncs
+type group struct {
+	l       *Log
+	mux     sync.Mutex
+	cur     *batch
+	stopped bool
+	quit    chan struct{}
+}
+
+type batch struct {
+	done chan struct{}
+	err  error
+}
+
+func newGroup(l *Log) *group {
+	g := &group{l: l, quit: make(chan struct{})}
+	go g.run()
+	return g
+}
+
+func (g *group) wait() error {
+	g.mux.Lock()
+	if g.stopped {
+		// Close synced the log
+		g.mux.Unlock()
+		return g.l.failed()
+	}
+	if g.cur == nil {
+		g.cur = &batch{done: make(chan struct{})}
+	}
+	b := g.cur
+	g.mux.Unlock()
+	<-b.done
+	return b.err
+}
+
+func (g *group) run() {
+	ticker := time.NewTicker(g.l.opts.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			g.flush()
+		case <-g.quit:
+			return
+		}
+	}
+}
+
+// flush syncs the active segment and releases the writers of the current batch
+func (g *group) flush() {
+	g.mux.Lock()
+	b := g.cur
+	g.cur = nil
+	g.mux.Unlock()
+	if b == nil {
+		return
+	}
+	if b.err = g.l.Sync(); b.err == ErrClosed {
+		// Close synced the log
+		b.err = g.l.failed()
+	}
+	close(b.done)
+}
+
+// stop releases the writers still waiting after Close synced the log
+func (g *group) stop() {
+	g.mux.Lock()
+	g.stopped = true
+	g.mux.Unlock()
+	close(g.quit)
+	g.flush()
+}
@@ -0,0 +1,159 @@
+// Copyright (c) 2023, donnie <donnie4w@gmail.com>
+// All rights reserved.
+// Use of t source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// github.com/donnie4w/gofer/wal
+
+package wal
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func readAll(t *testing.T, l *Log, from int64) (offs []int64, recs []string) {
+	t.Helper()
+	it, err := l.Iterator(from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	for it.Next() {
+		offs = append(offs, it.Offset())
+		recs = append(recs, string(it.Record()))
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestWriteReplay(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, &Options{SegmentSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var offs []int64
+	for i := 0; i < 20; i++ {
+		off, err := l.Write([]byte(fmt.Sprint("record", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		offs = append(offs, off)
+	}
+	if len(l.bases) < 3 {
+		t.Fatalf("expected several segments, got %v", l.bases)
+	}
+	got, recs := readAll(t, l, 0)
+	if len(recs) != 20 || recs[19] != "record19" || fmt.Sprint(got) != fmt.Sprint(offs) {
+		t.Fatalf("replay: %v %v", got, recs)
+	}
+	_, recs = readAll(t, l, offs[15])
+	if len(recs) != 5 || recs[0] != "record15" {
+		t.Fatalf("replay from offset: %v", recs)
+	}
+	if _, err := l.Iterator(l.Offset() + 1); err != ErrOffset {
+		t.Fatalf("expected ErrOffset, got %v", err)
+	}
+	l.Close()
+	if _, err := l.Write([]byte("x")); err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+
+	l, err = Open(dir, &Options{SegmentSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if off, _ := l.Write([]byte("after reopen")); off != l.Offset()-int64(headerSize+len("after reopen")) {
+		t.Fatalf("offset after reopen %d", off)
+	}
+	if _, recs = readAll(t, l, 0); len(recs) != 21 || recs[20] != "after reopen" {
+		t.Fatalf("replay after reopen: %v", recs)
+	}
+}
+
+func TestTornTail(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Write([]byte("first"))
+	l.Write([]byte("second"))
+	end := l.Offset()
+	l.Close()
+
+	// a crash in the middle of a write leaves a partial record
+	f, _ := os.OpenFile(l.segmentPath(0), os.O_WRONLY|os.O_APPEND, 0)
+	f.Write([]byte{0, 0, 0, 100, 1, 2, 3, 4, 'p', 'a', 'r'})
+	f.Close()
+
+	l, err = Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Offset() != end {
+		t.Fatalf("torn tail not truncated: %d != %d", l.Offset(), end)
+	}
+	l.Write([]byte("third"))
+	if _, recs := readAll(t, l, 0); fmt.Sprint(recs) != "[first second third]" {
+		t.Fatalf("replay: %v", recs)
+	}
+	end = l.Offset()
+	l.Close()
+
+	// some file systems leave a zero-filled tail after a crash
+	f, _ = os.OpenFile(l.segmentPath(0), os.O_WRONLY|os.O_APPEND, 0)
+	f.Write(make([]byte, 64))
+	f.Close()
+
+	l, err = Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if l.Offset() != end {
+		t.Fatalf("zero tail not truncated: %d != %d", l.Offset(), end)
+	}
+	if _, recs := readAll(t, l, 0); fmt.Sprint(recs) != "[first second third]" {
+		t.Fatalf("replay: %v", recs)
+	}
+}
+
+func TestSyncPolicies(t *testing.T) {
+	for _, p := range []SyncPolicy{SyncAlways, SyncGroup, SyncOS} {
+		l, err := Open(t.TempDir(), &Options{Sync: p, SyncInterval: 2 * time.Millisecond, SegmentSize: 1 << 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 50; j++ {
+					if _, err := l.Write([]byte(fmt.Sprint("policy", p, "-", i, "-", j))); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		if p != SyncOS && l.active.synced != l.active.written {
+			t.Fatalf("policy %d: %d of %d bytes synced", p, l.active.synced, l.active.written)
+		}
+		if _, recs := readAll(t, l, 0); len(recs) != 400 {
+			t.Fatalf("policy %d: %d records", p, len(recs))
+		}
+		if err := l.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright (c) 2023, donnie <donnie4w@gmail.com>
+// All rights reserved.
+// Use of t source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// github.com/donnie4w/gofer/websocket
+
+package websocket
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/donnie4w/gofer/compress"
+)
+
+const deflateWindow = 1 << 15
+
+// deflateTail is the empty stored block stripped from every compressed message (RFC 7692 7.2.1),
+// followed by a final empty block so the decompressor ends with io.EOF
+var deflateTail = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+
+// deflater holds the permessage-deflate state of a connection
+type deflater struct {
+	level     int
+	threshold int
+	// writeTakeover keeps the compression window between messages
+	writeTakeover bool
+	// readTakeover keeps the decompression window between messages
+	readTakeover bool
+	buf          bytes.Buffer
+	fw           *flate.Writer
+	dict         []byte
+}
+
+func deflateOffer(cfg *Config) string {
+	offer := "permessage-deflate"
+	if cfg.ClientNoContextTakeover {
+		offer += "; client_no_context_takeover"
+	}
+	if cfg.ServerNoContextTakeover {
+		offer += "; server_no_context_takeover"
+	}
+	return offer
+}
+
+// acceptDeflate validates the extension response of the server
+func acceptDeflate(ext string, cfg *Config) (*deflater, error) {
+	d := &deflater{level: cfg.CompressionLevel, threshold: cfg.CompressionThreshold, writeTakeover: !cfg.ClientNoContextTakeover, readTakeover: !cfg.ServerNoContextTakeover}
+	if d.level == 0 {
+		d.level = flate.BestSpeed
+	}
+	params := strings.Split(ext, ";")
+	if strings.TrimSpace(params[0]) != "permessage-deflate" || strings.Contains(ext, ",") {
+		return nil, fmt.Errorf("%w: unsupported extension %q", ErrBadHandshake, ext)
+	}
+	for _, p := range params[1:] {
+		name, _, _ := strings.Cut(strings.TrimSpace(p), "=")
+		switch name {
+		case "client_no_context_takeover":
+			d.writeTakeover = false
+		case "server_no_context_takeover":
+			d.readTakeover = false
+		case "server_max_window_bits":
+			// a smaller window of the server is always readable with a 32KB window
+		default:
+			// client_max_window_bits was not offered, compress/flate always uses a 32KB window
+			return nil, fmt.Errorf("%w: unsupported extension parameter %q", ErrBadHandshake, name)
+		}
+	}
+	return d, nil
+}
+
+func (d *deflater) compress(data []byte) (_r []byte, err error) {
+	d.buf.Reset()
+	if d.fw == nil {
+		if d.fw, err = flate.NewWriter(&d.buf, d.level); err != nil {
+			return
+		}
+	} else if !d.writeTakeover {
+		d.fw.Reset(&d.buf)
+	}
+	if _, err = d.fw.Write(data); err != nil {
+		return
+	}
+	if err = d.fw.Flush(); err != nil {
+		return
+	}
+	bs := d.buf.Bytes()
+	_r = make([]byte, len(bs)-4)
+	copy(_r, bs)
+	return
+}
+
+func (d *deflater) decompress(data []byte) (_r []byte, err error) {
+	fr := flate.NewReaderDict(io.MultiReader(bytes.NewReader(data), bytes.NewReader(deflateTail)), d.dict)
+	defer fr.Close()
+	var buf bytes.Buffer
+	if _, err = io.Copy(&buf, io.LimitReader(fr, maxMessageSize+1)); err != nil {
+		return
+	}
+	if buf.Len() > maxMessageSize {
+		return nil, ErrMessageTooBig
+	}
+	_r = buf.Bytes()
+	if d.readTakeover {
+		if len(_r) >= deflateWindow {
+			d.dict = append(d.dict[:0], _r[len(_r)-deflateWindow:]...)
+		} else {
+			d.dict = append(d.dict, _r...)
+			if len(d.dict) > deflateWindow {
+				d.dict = d.dict[len(d.dict)-deflateWindow:]
+			}
+		}
+	}
+	return
+}
+
+// AppCompress is an application level compression of messages for peers that both use gofer.
+// Every message is prefixed with a flag byte naming the algorithm it was compressed with.
+type AppCompress byte
+
+const (
+	AppCompressNone AppCompress = iota
+	AppCompressZstd
+	AppCompressSnappy
+)
+
+var ErrAppCompressFlag = errors.New("websocket: unknown compression flag")
+
+// appEncode prefixes msg with its flag byte, compressing it when it reaches threshold
+func appEncode(c AppCompress, threshold int, msg []byte) (_r []byte, err error) {
+	if len(msg) < threshold {
+		c = AppCompressNone
+	}
+	var bs []byte
+	switch c {
+	case AppCompressZstd:
+		if bs, err = compress.Zstd(msg); err != nil {
+			return
+		}
+	case AppCompressSnappy:
+		bs = compress.Snappy(msg)
+	default:
+		c, bs = AppCompressNone, msg
+	}
+	_r = make([]byte, len(bs)+1)
+	_r[0] = byte(c)
+	copy(_r[1:], bs)
+	return
+}
+
+func appDecode(msg []byte) (_r []byte, err error) {
+	if len(msg) == 0 {
+		return nil, ErrAppCompressFlag
+	}
+	switch AppCompress(msg[0]) {
+	case AppCompressNone:
+		return msg[1:], nil
+	case AppCompressZstd:
+		return compress.UnZstd(msg[1:])
+	case AppCompressSnappy:
+		return compress.UnSnappy(msg[1:])
+	default:
+		return nil, ErrAppCompressFlag
+	}
+}
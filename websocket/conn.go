@@ -0,0 +1,454 @@
+// Copyright (c) 2023, donnie <donnie4w@gmail.com>
+// All rights reserved.
+// Use of t source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// github.com/donnie4w/gofer/websocket
+
+package websocket
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+const (
+	finBit  = 0x80
+	rsv1Bit = 0x40
+	maskBit = 0x80
+
+	maxControlPayload = 125
+	maxMessageSize    = 32 << 20
+)
+
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+var (
+	ErrBadHandshake  = errors.New("websocket: bad handshake")
+	ErrBadFrame      = errors.New("websocket: bad frame")
+	ErrMessageTooBig = errors.New("websocket: message too big")
+)
+
+// wsConn is a minimal RFC 6455 connection with permessage-deflate support
+type wsConn struct {
+	rwc      net.Conn
+	br       *bufio.Reader
+	wlock    chan struct{}
+	client   bool
+	protocol string
+	deflate  *deflater
+	onPong   func(data []byte)
+	// closeSent is set once a close frame was written, guarded by wlock
+	closeSent bool
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newConn(rwc net.Conn, br *bufio.Reader, client bool) *wsConn {
+	if br == nil {
+		br = bufio.NewReader(rwc)
+	}
+	return &wsConn{rwc: rwc, br: br, client: client, wlock: make(chan struct{}, 1), closed: make(chan struct{})}
+}
+
+// handshake performs the client opening handshake on rwc
+func handshake(rwc net.Conn, cfg *Config, location, origin *url.URL) (c *wsConn, err error) {
+	if cfg.TimeOut > 0 {
+		rwc.SetDeadline(time.Now().Add(cfg.TimeOut))
+		defer rwc.SetDeadline(time.Time{})
+	}
+	nonce := make([]byte, 16)
+	if _, err = rand.Read(nonce); err != nil {
+		return
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+	bw := bufio.NewWriter(rwc)
+	fmt.Fprintf(bw, "GET %s HTTP/1.1\r\n", location.RequestURI())
+	fmt.Fprintf(bw, "Host: %s\r\n", location.Host)
+	bw.WriteString("Upgrade: websocket\r\nConnection: Upgrade\r\n")
+	fmt.Fprintf(bw, "Sec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n", key)
+	if origin != nil {
+		fmt.Fprintf(bw, "Origin: %s\r\n", origin.String())
+	}
+	if len(cfg.Protocols) > 0 {
+		fmt.Fprintf(bw, "Sec-WebSocket-Protocol: %s\r\n", strings.Join(cfg.Protocols, ", "))
+	}
+	if cfg.Compression {
+		fmt.Fprintf(bw, "Sec-WebSocket-Extensions: %s\r\n", deflateOffer(cfg))
+	}
+	if err = cfg.Header.WriteSubset(bw, handshakeHeader); err != nil {
+		return
+	}
+	bw.WriteString("\r\n")
+	if err = bw.Flush(); err != nil {
+		return
+	}
+	br := bufio.NewReader(rwc)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodGet})
+	if err != nil {
+		return
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols ||
+		!strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") ||
+		!headerContains(resp.Header, "Connection", "upgrade") ||
+		resp.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		return nil, fmt.Errorf("%w: %s", ErrBadHandshake, resp.Status)
+	}
+	c = newConn(rwc, br, true)
+	if c.protocol = resp.Header.Get("Sec-WebSocket-Protocol"); c.protocol != "" && !contains(cfg.Protocols, c.protocol) {
+		return nil, fmt.Errorf("%w: unexpected subprotocol %q", ErrBadHandshake, c.protocol)
+	}
+	if ext := resp.Header.Get("Sec-WebSocket-Extensions"); ext != "" {
+		if !cfg.Compression {
+			return nil, fmt.Errorf("%w: unexpected extension %q", ErrBadHandshake, ext)
+		}
+		if c.deflate, err = acceptDeflate(ext, cfg); err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+var handshakeHeader = map[string]bool{
+	"Host":                     true,
+	"Upgrade":                  true,
+	"Connection":               true,
+	"Sec-Websocket-Key":        true,
+	"Sec-Websocket-Version":    true,
+	"Sec-Websocket-Protocol":   true,
+	"Sec-Websocket-Extensions": true,
+	"Origin":                   true,
+}
+
+func acceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, s := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// lock acquires the write lock, giving up when ctx is done
+func (c *wsConn) lock(ctx context.Context) error {
+	select {
+	case c.wlock <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *wsConn) unlock() {
+	<-c.wlock
+}
+
+// writeMessage writes a data message as a single frame, compressing it if deflate was negotiated.
+// The deadline and cancellation of ctx apply to the write, an interrupted write closes the connection.
+func (c *wsConn) writeMessage(ctx context.Context, op byte, data []byte) (err error) {
+	if err = c.lock(ctx); err != nil {
+		return
+	}
+	defer c.unlock()
+	if c.closeSent {
+		return ErrClosed
+	}
+	rsv := byte(0)
+	if c.deflate != nil && len(data) >= c.deflate.threshold {
+		if data, err = c.deflate.compress(data); err != nil {
+			return
+		}
+		rsv = rsv1Bit
+	}
+	if d, ok := ctx.Deadline(); ok {
+		c.rwc.SetWriteDeadline(d)
+		defer c.rwc.SetWriteDeadline(time.Time{})
+	}
+	if ctx.Done() != nil {
+		stop := context.AfterFunc(ctx, func() { c.rwc.SetWriteDeadline(time.Unix(1, 0)) })
+		defer stop()
+	}
+	if err = c.writeFrame(op, rsv, data); err != nil {
+		c.Close()
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		} else if _, ok := ctx.Deadline(); ok && errors.Is(err, os.ErrDeadlineExceeded) {
+			// the socket deadline fired before the timer of ctx
+			err = context.DeadlineExceeded
+		}
+	}
+	return
+}
+
+// writeControl writes a control frame, it may be called concurrently with writeMessage
+func (c *wsConn) writeControl(op byte, data []byte) error {
+	c.lock(context.Background())
+	defer c.unlock()
+	if c.closeSent {
+		return ErrClosed
+	}
+	return c.writeFrame(op, 0, data)
+}
+
+// writeClose starts or completes the closing handshake, it is a no-op if a close frame was already sent
+func (c *wsConn) writeClose(code int, reason string, deadline time.Time) (err error) {
+	c.lock(context.Background())
+	defer c.unlock()
+	if c.closeSent {
+		return
+	}
+	c.closeSent = true
+	data := []byte{}
+	if code != CloseNoStatus {
+		data = binary.BigEndian.AppendUint16(data, uint16(code))
+		if len(reason) > maxControlPayload-2 {
+			reason = reason[:maxControlPayload-2]
+		}
+		data = append(data, reason...)
+	}
+	c.rwc.SetWriteDeadline(deadline)
+	defer c.rwc.SetWriteDeadline(time.Time{})
+	return c.writeFrame(opClose, 0, data)
+}
+
+func (c *wsConn) writeFrame(op, rsv byte, data []byte) (err error) {
+	header := make([]byte, 2, 14)
+	header[0] = finBit | rsv | op
+	switch l := len(data); {
+	case l <= 125:
+		header[1] = byte(l)
+	case l <= 0xffff:
+		header[1] = 126
+		header = binary.BigEndian.AppendUint16(header, uint16(l))
+	default:
+		header[1] = 127
+		header = binary.BigEndian.AppendUint64(header, uint64(l))
+	}
+	if c.client {
+		header[1] |= maskBit
+		var mask [4]byte
+		if _, err = rand.Read(mask[:]); err != nil {
+			return
+		}
+		header = append(header, mask[:]...)
+		masked := make([]byte, len(data))
+		for i, b := range data {
+			masked[i] = b ^ mask[i&3]
+		}
+		data = masked
+	}
+	_, err = c.rwc.Write(append(header, data...))
+	return
+}
+
+type frameHeader struct {
+	fin    bool
+	rsv1   bool
+	op     byte
+	length int64
+	mask   []byte
+}
+
+func (c *wsConn) readFrameHeader() (h frameHeader, err error) {
+	var b [8]byte
+	if _, err = io.ReadFull(c.br, b[:2]); err != nil {
+		return
+	}
+	h.fin, h.rsv1, h.op = b[0]&finBit != 0, b[0]&rsv1Bit != 0, b[0]&0x0f
+	if b[0]&0x30 != 0 {
+		return h, ErrBadFrame
+	}
+	// permessage-deflate sets rsv1 on the first frame of a data message only
+	if h.rsv1 && (h.op == opContinuation || h.op >= opClose) {
+		return h, ErrBadFrame
+	}
+	// frames from the server must not be masked, frames from the client must be (RFC 6455 5.1)
+	masked := b[1]&maskBit != 0
+	if masked == c.client {
+		return h, ErrBadFrame
+	}
+	switch l := b[1] & 0x7f; l {
+	case 126:
+		if _, err = io.ReadFull(c.br, b[:2]); err != nil {
+			return
+		}
+		h.length = int64(binary.BigEndian.Uint16(b[:2]))
+	case 127:
+		if _, err = io.ReadFull(c.br, b[:8]); err != nil {
+			return
+		}
+		h.length = int64(binary.BigEndian.Uint64(b[:8]) & (1<<63 - 1))
+	default:
+		h.length = int64(l)
+	}
+	if masked {
+		h.mask = make([]byte, 4)
+		if _, err = io.ReadFull(c.br, h.mask); err != nil {
+			return
+		}
+	}
+	if h.op >= opClose && (!h.fin || h.length > maxControlPayload) {
+		err = ErrBadFrame
+	}
+	return
+}
+
+func (c *wsConn) readPayload(h frameHeader) (data []byte, err error) {
+	data = make([]byte, h.length)
+	if _, err = io.ReadFull(c.br, data); err != nil {
+		return
+	}
+	if h.mask != nil {
+		for i := range data {
+			data[i] ^= h.mask[i&3]
+		}
+	}
+	return
+}
+
+// readMessage reads the next data message, control frames are handled in between.
+// Ping frames are answered with a pong; a close frame ends the read with a *CloseError.
+// A frame that violates the protocol is answered with CloseProtocolError and ends the read with ErrBadFrame.
+func (c *wsConn) readMessage() (op byte, msg []byte, err error) {
+	defer func() {
+		if err == ErrBadFrame {
+			c.writeClose(CloseProtocolError, "", time.Now().Add(closeTimeout))
+		}
+	}()
+	compressed := false
+	for {
+		var h frameHeader
+		if h, err = c.readFrameHeader(); err != nil {
+			return
+		}
+		if int64(len(msg))+h.length > maxMessageSize {
+			return op, nil, ErrMessageTooBig
+		}
+		var data []byte
+		if data, err = c.readPayload(h); err != nil {
+			return
+		}
+		switch h.op {
+		case opPing:
+			if err = c.writeControl(opPong, data); err != nil {
+				return
+			}
+			continue
+		case opPong:
+			if c.onPong != nil {
+				c.onPong(data)
+			}
+			continue
+		case opClose:
+			ce := parseClose(data)
+			c.writeClose(ce.Code, "", time.Now().Add(closeTimeout))
+			return opClose, nil, ce
+		case opContinuation:
+			if op == 0 {
+				return op, nil, ErrBadFrame
+			}
+		case opText, opBinary:
+			if op != 0 {
+				return op, nil, ErrBadFrame
+			}
+			op, compressed = h.op, h.rsv1
+			if compressed && c.deflate == nil {
+				return op, nil, ErrBadFrame
+			}
+		default:
+			return op, nil, ErrBadFrame
+		}
+		msg = append(msg, data...)
+		if h.fin {
+			break
+		}
+	}
+	if compressed {
+		msg, err = c.deflate.decompress(msg)
+	}
+	return
+}
+
+// Close status codes defined by RFC 6455 7.4.1
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseUnsupportedData = 1003
+	CloseNoStatus        = 1005
+	CloseAbnormal        = 1006
+	CloseInvalidPayload  = 1007
+	ClosePolicyViolation = 1008
+	CloseMessageTooBig   = 1009
+	CloseInternalError   = 1011
+)
+
+// closeTimeout bounds the closing handshake
+const closeTimeout = 5 * time.Second
+
+// CloseError is returned when the peer closes the connection with a close frame
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket: close %d %s", e.Code, e.Reason)
+}
+
+func parseClose(data []byte) *CloseError {
+	ce := &CloseError{Code: CloseNoStatus}
+	if len(data) >= 2 {
+		ce.Code = int(binary.BigEndian.Uint16(data))
+		ce.Reason = string(data[2:])
+	}
+	return ce
+}
+
+func (c *wsConn) Close() (err error) {
+	c.closeOnce.Do(func() {
+		err = c.rwc.Close()
+		close(c.closed)
+	})
+	return
+}
@@ -0,0 +1,144 @@
+// Copyright (c) 2023, donnie <donnie4w@gmail.com>
+// All rights reserved.
+// Use of t source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// github.com/donnie4w/gofer/websocket
+
+package websocket
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// buildTLSConfig returns the tls configuration for a wss connection.
+// Server certificates are verified against CertFiles/CertBytes, or the system roots
+// when neither is given, unless InsecureSkipVerify is set explicitly.
+func buildTLSConfig(cfg *Config) (tc *tls.Config, err error) {
+	tc = &tls.Config{ServerName: cfg.ServerName, InsecureSkipVerify: cfg.InsecureSkipVerify}
+	if cfg.CertFiles != nil {
+		if tc.RootCAs, err = loadCACertificatesFromFiles(cfg.CertFiles); err != nil {
+			return nil, err
+		}
+	} else if cfg.CertBytes != nil {
+		if tc.RootCAs, err = loadCACertificatesFromBytes(cfg.CertBytes); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.ClientCertFile != "" || cfg.ClientKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.ClientCertFile, cfg.ClientKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tc.Certificates = append(tc.Certificates, cert)
+	}
+	tc.Certificates = append(tc.Certificates, cfg.ClientCerts...)
+	return
+}
+
+// dial opens the websocket connection, through cfg.Proxy if one is configured
+func dial(cfg *Config, location, origin *url.URL, tc *tls.Config) (ws *wsConn, err error) {
+	forward := &net.Dialer{Timeout: cfg.TimeOut}
+	addr := hostPort(location)
+	var conn net.Conn
+	if cfg.Proxy == "" {
+		conn, err = forward.Dial("tcp", addr)
+	} else {
+		var proxyUrl *url.URL
+		if proxyUrl, err = url.Parse(cfg.Proxy); err != nil {
+			return nil, err
+		}
+		switch proxyUrl.Scheme {
+		case "http", "https":
+			conn, err = dialConnect(forward, proxyUrl, addr, cfg.TimeOut)
+		case "socks5", "socks5h":
+			var d proxy.Dialer
+			if d, err = proxy.FromURL(proxyUrl, forward); err == nil {
+				conn, err = d.Dial("tcp", addr)
+			}
+		default:
+			err = errors.New("unsupported proxy scheme:" + proxyUrl.Scheme)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if location.Scheme == "wss" {
+		tc = tc.Clone()
+		if tc.ServerName == "" {
+			tc.ServerName = location.Hostname()
+		}
+		tlsConn := tls.Client(conn, tc)
+		if cfg.TimeOut > 0 {
+			conn.SetDeadline(time.Now().Add(cfg.TimeOut))
+		}
+		if err = tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn.SetDeadline(time.Time{})
+		conn = tlsConn
+	}
+	if ws, err = handshake(conn, cfg, location, origin); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return
+}
+
+// dialConnect establishes a tunnel to addr through an HTTP proxy with the CONNECT method,
+// the exchange with the proxy is bounded by timeout if it is not zero
+func dialConnect(forward *net.Dialer, proxyUrl *url.URL, addr string, timeout time.Duration) (conn net.Conn, err error) {
+	if conn, err = forward.Dial("tcp", hostPort(proxyUrl)); err != nil {
+		return
+	}
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+	if proxyUrl.Scheme == "https" {
+		conn = tls.Client(conn, &tls.Config{ServerName: proxyUrl.Hostname()})
+	}
+	req := &http.Request{Method: http.MethodConnect, URL: &url.URL{Opaque: addr}, Host: addr, Header: http.Header{}}
+	if u := proxyUrl.User; u != nil {
+		pwd, _ := u.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(u.Username()+":"+pwd)))
+	}
+	if err = req.Write(conn); err == nil {
+		var resp *http.Response
+		if resp, err = http.ReadResponse(bufio.NewReader(conn), req); err == nil {
+			if resp.StatusCode != http.StatusOK {
+				err = fmt.Errorf("proxy CONNECT failed: %s", resp.Status)
+			}
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return
+}
+
+func hostPort(u *url.URL) string {
+	if port := u.Port(); port != "" {
+		return u.Host
+	}
+	switch u.Scheme {
+	case "wss", "https":
+		return net.JoinHostPort(u.Hostname(), "443")
+	case "socks5", "socks5h":
+		return net.JoinHostPort(u.Hostname(), "1080")
+	default:
+		return net.JoinHostPort(u.Hostname(), "80")
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright (c) 2023, donnie <donnie4w@gmail.com>
+// All rights reserved.
+// Use of t source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// github.com/donnie4w/gofer/websocket
+
+package websocket
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/donnie4w/gofer/pool/gopool"
+	"github.com/donnie4w/gofer/util"
+)
+
+// DispatchMode determines how received messages are handed to OnMessage.
+type DispatchMode int
+
+const (
+	// DispatchAsync starts a new goroutine for every message (legacy behaviour).
+	DispatchAsync DispatchMode = iota
+	// DispatchSequential delivers messages one at a time, in the order they were received.
+	DispatchSequential
+	// DispatchPool delivers messages on a bounded gopool worker pool; ordering is not preserved.
+	DispatchPool
+	// DispatchKeyed delivers messages in order per partition key, partitions run in parallel.
+	DispatchKeyed
+)
+
+// OverflowPolicy determines what happens when the dispatch queue is full.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock blocks the read loop until the queue has room.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDrop discards the message.
+	OverflowDrop
+	// OverflowClose closes the connection with ErrQueueOverflow.
+	OverflowClose
+)
+
+var ErrQueueOverflow = errors.New("websocket: message queue overflow")
+
+const (
+	defaultQueueSize  = 1 << 10
+	defaultWorkers    = 16
+	defaultPartitions = 16
+)
+
+type dispatcher interface {
+	// dispatch queues msg, it returns false if msg could not be queued
+	dispatch(msg []byte) bool
+	// close stops accepting messages and waits for queued messages to be delivered
+	close()
+}
+
+func newDispatcher(wh *Handler) dispatcher {
+	cfg := wh.Cfg
+	queueSize := cfg.QueueSize
+	if queueSize <= 0 {
+		queueSize = defaultQueueSize
+	}
+	switch cfg.Dispatch {
+	case DispatchSequential:
+		return newSerialDispatcher(wh, queueSize, cfg.Overflow)
+	case DispatchPool:
+		workers := cfg.Workers
+		if workers <= 0 {
+			workers = defaultWorkers
+		}
+		return newPoolDispatcher(wh, workers, queueSize, cfg.Overflow)
+	case DispatchKeyed:
+		partitions := cfg.Partitions
+		if partitions <= 0 {
+			partitions = defaultPartitions
+		}
+		return newKeyedDispatcher(wh, partitions, queueSize, cfg.Overflow, cfg.PartitionKey)
+	default:
+		return &asyncDispatcher{wh: wh}
+	}
+}
+
+type asyncDispatcher struct {
+	wh *Handler
+}
+
+func (d *asyncDispatcher) dispatch(msg []byte) bool {
+	go d.wh.Cfg.OnMessage(d.wh, msg)
+	return true
+}
+
+func (d *asyncDispatcher) close() {}
+
+type serialDispatcher struct {
+	wh     *Handler
+	ch     chan []byte
+	policy OverflowPolicy
+	wg     sync.WaitGroup
+}
+
+func newSerialDispatcher(wh *Handler, queueSize int, policy OverflowPolicy) *serialDispatcher {
+	d := &serialDispatcher{wh: wh, ch: make(chan []byte, queueSize), policy: policy}
+	d.wg.Add(1)
+	go d.run()
+	return d
+}
+
+func (d *serialDispatcher) run() {
+	defer d.wg.Done()
+	for msg := range d.ch {
+		d.wh.onMessage(msg)
+	}
+}
+
+func (d *serialDispatcher) dispatch(msg []byte) bool {
+	if d.policy == OverflowBlock {
+		d.ch <- msg
+		return true
+	}
+	select {
+	case d.ch <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+func (d *serialDispatcher) close() {
+	close(d.ch)
+	d.wg.Wait()
+}
+
+type poolDispatcher struct {
+	wh     *Handler
+	pool   *gopool.GoPool
+	policy OverflowPolicy
+}
+
+func newPoolDispatcher(wh *Handler, workers, queueSize int, policy OverflowPolicy) *poolDispatcher {
+	return &poolDispatcher{
+		wh:     wh,
+		pool:   gopool.NewPoolWithFuncLimit(int64(workers), int64(workers), queueSize),
+		policy: policy,
+	}
+}
+
+func (d *poolDispatcher) dispatch(msg []byte) bool {
+	f := func() { d.wh.onMessage(msg) }
+	if d.policy == OverflowBlock {
+		d.pool.Go(f)
+		return true
+	}
+	return d.pool.TryGo(f)
+}
+
+func (d *poolDispatcher) close() {
+	d.pool.Shutdown(context.Background())
+}
+
+type keyedDispatcher struct {
+	parts []*serialDispatcher
+	key   func(msg []byte) string
+}
+
+func newKeyedDispatcher(wh *Handler, partitions, queueSize int, policy OverflowPolicy, key func([]byte) string) *keyedDispatcher {
+	d := &keyedDispatcher{parts: make([]*serialDispatcher, partitions), key: key}
+	for i := range d.parts {
+		d.parts[i] = newSerialDispatcher(wh, queueSize, policy)
+	}
+	return d
+}
+
+func (d *keyedDispatcher) dispatch(msg []byte) bool {
+	idx := util.FNVHash64([]byte(d.key(msg))) % uint64(len(d.parts))
+	return d.parts[idx].dispatch(msg)
+}
+
+func (d *keyedDispatcher) close() {
+	for _, p := range d.parts {
+		p.close()
+	}
+}
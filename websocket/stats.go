@@ -0,0 +1,147 @@
+// Copyright (c) 2023, donnie <donnie4w@gmail.com>
+// All rights reserved.
+// Use of t source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// github.com/donnie4w/gofer/websocket
+
+package websocket
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+)
+
+// State is the lifecycle state of a Handler
+type State int32
+
+const (
+	StateConnecting State = iota
+	StateOpen
+	StateClosing
+	StateClosed
+)
+
+func (s State) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateOpen:
+		return "open"
+	case StateClosing:
+		return "closing"
+	case StateClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+// Stats is a snapshot of the counters of a Handler
+type Stats struct {
+	State            State
+	MessagesSent     int64
+	MessagesReceived int64
+	BytesSent        int64
+	BytesReceived    int64
+	Reconnects       int64
+	LastSent         time.Time
+	LastReceived     time.Time
+	// RTT is the round trip time measured by the last ping/pong exchange
+	RTT time.Duration
+}
+
+type counters struct {
+	msgSent      int64
+	msgReceived  int64
+	bytesSent    int64
+	bytesRecv    int64
+	reconnects   int64
+	lastSent     int64
+	lastReceived int64
+	rtt          int64
+}
+
+func (c *counters) sent(n int) {
+	atomic.AddInt64(&c.msgSent, 1)
+	atomic.AddInt64(&c.bytesSent, int64(n))
+	atomic.StoreInt64(&c.lastSent, time.Now().UnixNano())
+}
+
+func (c *counters) received(n int) {
+	atomic.AddInt64(&c.msgReceived, 1)
+	atomic.AddInt64(&c.bytesRecv, int64(n))
+	atomic.StoreInt64(&c.lastReceived, time.Now().UnixNano())
+}
+
+// pong measures the round trip time from the timestamp carried by a ping sent with Handler.Ping
+func (c *counters) pong(data []byte) {
+	if len(data) == 8 {
+		if rtt := time.Now().UnixNano() - int64(binary.BigEndian.Uint64(data)); rtt >= 0 {
+			atomic.StoreInt64(&c.rtt, rtt)
+		}
+	}
+}
+
+func unixNano(n int64) (t time.Time) {
+	if n > 0 {
+		t = time.Unix(0, n)
+	}
+	return
+}
+
+// State returns the current lifecycle state
+func (wh *Handler) State() State {
+	return State(atomic.LoadInt32(&wh.state))
+}
+
+// setState changes the state and notifies OnStateChange, it reports whether the state changed
+func (wh *Handler) setState(from []State, to State) bool {
+	for {
+		old := State(atomic.LoadInt32(&wh.state))
+		if from != nil && !containsState(from, old) {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&wh.state, int32(old), int32(to)) {
+			if old != to && wh.Cfg.OnStateChange != nil {
+				wh.Cfg.OnStateChange(wh, old, to)
+			}
+			return old != to
+		}
+	}
+}
+
+func containsState(ss []State, s State) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Stats returns a snapshot of the connection counters
+func (wh *Handler) Stats() Stats {
+	c := &wh.stats
+	return Stats{
+		State:            wh.State(),
+		MessagesSent:     atomic.LoadInt64(&c.msgSent),
+		MessagesReceived: atomic.LoadInt64(&c.msgReceived),
+		BytesSent:        atomic.LoadInt64(&c.bytesSent),
+		BytesReceived:    atomic.LoadInt64(&c.bytesRecv),
+		Reconnects:       atomic.LoadInt64(&c.reconnects),
+		LastSent:         unixNano(atomic.LoadInt64(&c.lastSent)),
+		LastReceived:     unixNano(atomic.LoadInt64(&c.lastReceived)),
+		RTT:              time.Duration(atomic.LoadInt64(&c.rtt)),
+	}
+}
+
+// Ping sends a ping frame, the RTT in Stats is updated when the pong arrives
+func (wh *Handler) Ping() error {
+	conn, err := wh.current()
+	if err != nil {
+		return err
+	}
+	return conn.writeControl(opPing, binary.BigEndian.AppendUint64(nil, uint64(time.Now().UnixNano())))
+}
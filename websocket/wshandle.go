@@ -8,18 +8,18 @@
 package websocket
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
 	"fmt"
-	"net"
+	"net/http"
 	"net/url"
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
-
-	wss "golang.org/x/net/websocket"
 )
 
 type Config struct {
@@ -32,107 +32,339 @@ type Config struct {
 	OnError   func(c *Handler, err error)
 	OnClose   func(c *Handler)
 	OnMessage func(c *Handler, msg []byte)
+
+	// Header is sent with the opening handshake, e.g. Authorization or Cookie
+	Header http.Header
+	// Protocols is offered as Sec-WebSocket-Protocol, see Handler.Protocol for the negotiated one
+	Protocols []string
+	// ClientCertFile and ClientKeyFile load a client certificate for mutual TLS
+	ClientCertFile string
+	ClientKeyFile  string
+	// ClientCerts are additional client certificates for mutual TLS
+	ClientCerts []tls.Certificate
+	// ServerName overrides the SNI host name and the name used to verify the server certificate
+	ServerName string
+	// InsecureSkipVerify disables server certificate verification, it must be set explicitly
+	InsecureSkipVerify bool
+	// Proxy is the proxy url, http://, https://, socks5:// and socks5h:// are supported
+	Proxy string
+
+	// Compression negotiates the permessage-deflate extension (RFC 7692)
+	Compression bool
+	// CompressionLevel is the compress/flate level, default flate.BestSpeed
+	CompressionLevel int
+	// CompressionThreshold is the minimum message size to compress, for both deflate and AppCompress
+	CompressionThreshold int
+	// ClientNoContextTakeover asks that the compression window is reset after every sent message
+	ClientNoContextTakeover bool
+	// ServerNoContextTakeover asks the server to reset its compression window after every message
+	ServerNoContextTakeover bool
+	// AppCompress compresses messages in the application layer, the peer must use the same framing
+	AppCompress AppCompress
+
+	// WriteTimeout bounds every Send, zero means no deadline
+	WriteTimeout time.Duration
+
+	// OnStateChange is called whenever the lifecycle state of the handler changes
+	OnStateChange func(c *Handler, old, new State)
+	// PingInterval sends a ping at this interval to keep the connection alive and measure RTT
+	PingInterval time.Duration
+
+	// Dispatch selects how messages are delivered to OnMessage, default DispatchAsync
+	Dispatch DispatchMode
+	// QueueSize is the number of messages buffered per queue, default 1024
+	QueueSize int
+	// Overflow is applied when a queue is full, default OverflowBlock
+	Overflow OverflowPolicy
+	// Workers is the pool size for DispatchPool, default 16
+	Workers int
+	// Partitions is the number of ordered queues for DispatchKeyed, default 16
+	Partitions int
+	// PartitionKey extracts the ordering key of a message, it is required by DispatchKeyed
+	PartitionKey func(msg []byte) string
 }
 
 type Handler struct {
-	Cfg  *Config
-	conn *wss.Conn
-	mux  *sync.Mutex
-	err  error
+	Cfg   *Config
+	conn  *wsConn
+	err   error
+	emux  sync.RWMutex
+	disp  dispatcher
+	done  chan struct{}
+	state int32
+	stats counters
+	// code and reason of the close frame of the last connection, see CloseCode
+	closeCode   int
+	closeReason string
 }
 
+var ErrClosed = errors.New("connection is closed")
+
 func NewHandler(cfg *Config) (wh *Handler, err error) {
-	var conn *wss.Conn
-	config := &wss.Config{Version: wss.ProtocolVersionHybi13}
-	if cfg.TimeOut > 0 {
-		config.Dialer = &net.Dialer{Timeout: cfg.TimeOut}
+	if cfg.Dispatch == DispatchKeyed && cfg.PartitionKey == nil {
+		return nil, errors.New("websocket: DispatchKeyed requires PartitionKey")
 	}
+	wh = &Handler{Cfg: cfg, state: int32(StateClosed)}
+	if err = wh.connect(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// connect dials the server and starts the read loop of the new connection
+func (wh *Handler) connect() (err error) {
+	cfg := wh.Cfg
+	wh.setState(nil, StateConnecting)
+	var conn *wsConn
+	var tc *tls.Config
 	if strings.HasPrefix(cfg.Url, "wss:") {
-		if cfg.CertFiles != nil {
-			if rootcas, e := loadCACertificatesFromFiles(cfg.CertFiles); e == nil {
-				config.TlsConfig = &tls.Config{
-					RootCAs:            rootcas,
-					InsecureSkipVerify: false,
-				}
-			} else {
-				return nil, e
-			}
-		} else if cfg.CertBytes != nil {
-			if rootcas, e := loadCACertificatesFromBytes(cfg.CertBytes); e == nil {
-				config.TlsConfig = &tls.Config{
-					RootCAs:            rootcas,
-					InsecureSkipVerify: false,
-				}
-			} else {
-				return nil, e
-			}
-		} else {
-			config.TlsConfig = &tls.Config{InsecureSkipVerify: true}
-		}
+		tc, err = buildTLSConfig(cfg)
 	} else if !strings.HasPrefix(cfg.Url, "ws:") {
-		return nil, errors.New("network transfer protocol error:" + cfg.Url)
+		err = errors.New("network transfer protocol error:" + cfg.Url)
 	}
-	if config.Location, err = url.ParseRequestURI(cfg.Url); err == nil {
-		if config.Origin, err = url.ParseRequestURI(cfg.Origin); err == nil {
-			conn, err = wss.DialConfig(config)
+	if err == nil {
+		var location, origin *url.URL
+		if location, err = url.ParseRequestURI(cfg.Url); err == nil {
+			if origin, err = url.ParseRequestURI(cfg.Origin); err == nil {
+				conn, err = dial(cfg, location, origin, tc)
+			}
 		}
 	}
-	if err == nil && conn != nil {
-		wh = &Handler{cfg, conn, &sync.Mutex{}, nil}
-		if cfg.OnOpen != nil {
-			cfg.OnOpen(wh)
-		}
-		go wh.read()
+	if err != nil {
+		wh.setState(nil, StateClosed)
+		return
+	}
+	conn.onPong = wh.stats.pong
+	var disp dispatcher
+	if cfg.OnMessage != nil {
+		disp = newDispatcher(wh)
+	}
+	done := make(chan struct{})
+	wh.emux.Lock()
+	wh.conn, wh.disp, wh.done, wh.err = conn, disp, done, nil
+	wh.emux.Unlock()
+	wh.setState(nil, StateOpen)
+	if cfg.OnOpen != nil {
+		cfg.OnOpen(wh)
+	}
+	go wh.read(conn, disp, done)
+	if cfg.PingInterval > 0 {
+		go wh.keepalive(done)
 	}
 	return
 }
 
-func (wh *Handler) sendws(bs []byte) (err error) {
-	wh.mux.Lock()
-	defer wh.mux.Unlock()
-	return wss.Message.Send(wh.conn, bs)
+// Reconnect closes the current connection if it is still open and dials the server again with the same Config.
+// Queued messages and OnClose of the old connection may be delivered after the new connection is open.
+func (wh *Handler) Reconnect() (err error) {
+	wh.Close()
+	wh.emux.RLock()
+	done := wh.done
+	wh.emux.RUnlock()
+	if done != nil {
+		<-done
+	}
+	if err = wh.connect(); err == nil {
+		atomic.AddInt64(&wh.stats.reconnects, 1)
+	}
+	return
 }
 
-func (wh *Handler) Send(bs []byte) error {
+// current returns the open connection
+func (wh *Handler) current() (*wsConn, error) {
+	wh.emux.RLock()
+	defer wh.emux.RUnlock()
 	if wh.err != nil {
-		return wh.err
+		return nil, wh.err
 	}
-	return wh.sendws(bs)
+	return wh.conn, nil
 }
 
-func (wh *Handler) Close() (err error) {
-	wh.err = errors.New("connection is closed")
-	if wh.conn != nil {
-		err = wh.conn.Close()
+func (wh *Handler) sendws(ctx context.Context, conn *wsConn, bs []byte) (err error) {
+	n := len(bs)
+	if wh.Cfg.AppCompress != AppCompressNone {
+		if bs, err = appEncode(wh.Cfg.AppCompress, wh.Cfg.CompressionThreshold, bs); err != nil {
+			return
+		}
+	}
+	if err = conn.writeMessage(ctx, opBinary, bs); err == nil {
+		wh.stats.sent(n)
 	}
 	return
 }
 
+// Send sends a binary message, it is bounded by Config.WriteTimeout
+func (wh *Handler) Send(bs []byte) error {
+	ctx := context.Background()
+	if wh.Cfg.WriteTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, wh.Cfg.WriteTimeout)
+		defer cancel()
+	}
+	return wh.SendContext(ctx, bs)
+}
+
+// SendContext sends a binary message, waiting for the connection and writing it within the deadline of ctx.
+// A write interrupted by ctx leaves a partial frame on the wire, so the connection is closed.
+func (wh *Handler) SendContext(ctx context.Context, bs []byte) error {
+	conn, err := wh.current()
+	if err != nil {
+		return err
+	}
+	return wh.sendws(ctx, conn, bs)
+}
+
+// Close performs the closing handshake with CloseNormal
+func (wh *Handler) Close() error {
+	return wh.CloseWithCode(CloseNormal, "")
+}
+
+// CloseWithCode sends a close frame with code and reason, then waits for the close frame of the peer
+// before the connection is closed. The wait is bounded by Config.TimeOut, or 5 seconds if it is not set.
+func (wh *Handler) CloseWithCode(code int, reason string) (err error) {
+	conn, err := wh.current()
+	if err != nil {
+		return wh.closeConn()
+	}
+	wh.setErr(ErrClosed)
+	wh.setState([]State{StateConnecting, StateOpen}, StateClosing)
+	timeout := closeTimeout
+	if wh.Cfg.TimeOut > 0 {
+		timeout = wh.Cfg.TimeOut
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	if err = conn.writeClose(code, reason, time.Now().Add(timeout)); err == nil {
+		select {
+		case <-conn.closed:
+			return
+		case <-timer.C:
+		}
+	}
+	if e := conn.Close(); err == nil {
+		err = e
+	}
+	return
+}
+
+// closeConn closes the socket without a closing handshake
+func (wh *Handler) closeConn() (err error) {
+	wh.setErr(ErrClosed)
+	wh.setState([]State{StateConnecting, StateOpen}, StateClosing)
+	wh.emux.RLock()
+	conn := wh.conn
+	wh.emux.RUnlock()
+	if conn != nil {
+		err = conn.Close()
+	}
+	return
+}
+
+// Protocol returns the subprotocol accepted by the server, or an empty string if none was offered
+func (wh *Handler) Protocol() string {
+	wh.emux.RLock()
+	defer wh.emux.RUnlock()
+	return wh.conn.protocol
+}
+
+// Compressed reports whether permessage-deflate was negotiated with the server
+func (wh *Handler) Compressed() bool {
+	wh.emux.RLock()
+	defer wh.emux.RUnlock()
+	return wh.conn.deflate != nil
+}
+
+// CloseCode returns the status code of the close frame received from the peer on the last closed
+// connection, CloseAbnormal if it was closed without one, or zero if no connection was closed yet
+func (wh *Handler) CloseCode() int {
+	wh.emux.RLock()
+	defer wh.emux.RUnlock()
+	return wh.closeCode
+}
+
+// CloseReason returns the reason of the close frame received from the peer on the last closed connection
+func (wh *Handler) CloseReason() string {
+	wh.emux.RLock()
+	defer wh.emux.RUnlock()
+	return wh.closeReason
+}
+
 func (wh *Handler) Error() error {
+	wh.emux.RLock()
+	defer wh.emux.RUnlock()
 	return wh.err
 }
 
-func (wh *Handler) read() {
+// setErr records the first error of the connection, later errors are ignored
+func (wh *Handler) setErr(err error) {
+	wh.emux.Lock()
+	defer wh.emux.Unlock()
+	if wh.err == nil {
+		wh.err = err
+	}
+}
+
+// read runs the read loop of conn. done is closed once the connection is closed, before queued messages
+// are delivered and OnClose is called, so Reconnect may be called from OnMessage and OnClose.
+func (wh *Handler) read(conn *wsConn, disp dispatcher, done chan struct{}) {
 	var err error
-	for wh.err == nil {
+	code, reason := CloseAbnormal, ""
+	for {
 		var byt []byte
-		if err = wss.Message.Receive(wh.conn, &byt); err != nil {
-			wh.err = err
+		if _, byt, err = conn.readMessage(); err == nil && wh.Cfg.AppCompress != AppCompressNone {
+			byt, err = appDecode(byt)
+		}
+		if err != nil {
+			if ce, ok := err.(*CloseError); ok {
+				code, reason = ce.Code, ce.Reason
+			}
+			wh.setErr(err)
 			break
 		}
-		if byt != nil && wh.Cfg.OnMessage != nil {
-			go wh.Cfg.OnMessage(wh, byt)
+		wh.stats.received(len(byt))
+		if byt != nil && disp != nil && !disp.dispatch(byt) && wh.Cfg.Overflow == OverflowClose {
+			err = ErrQueueOverflow
+			wh.setErr(err)
+			break
 		}
 	}
 	if wh.Cfg.OnError != nil {
 		go wh.Cfg.OnError(wh, err)
 	}
-	wh.Close()
+	wh.closeConn()
+	wh.emux.Lock()
+	wh.closeCode, wh.closeReason = code, reason
+	wh.emux.Unlock()
+	wh.setState(nil, StateClosed)
+	close(done)
+	if disp != nil {
+		disp.close()
+	}
 	if wh.Cfg.OnClose != nil {
 		wh.Cfg.OnClose(wh)
 	}
 }
 
+// keepalive pings the server every PingInterval until the connection is closed
+func (wh *Handler) keepalive(done chan struct{}) {
+	ticker := time.NewTicker(wh.Cfg.PingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := wh.Ping(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (wh *Handler) onMessage(msg []byte) {
+	wh.Cfg.OnMessage(wh, msg)
+}
+
 func recoverable(err *error) {
 	if e := recover(); e != nil {
 		if err != nil {
@@ -0,0 +1,645 @@
+// Copyright (c) 2023, donnie <donnie4w@gmail.com>
+// All rights reserved.
+// Use of t source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//
+// github.com/donnie4w/gofer/websocket
+
+package websocket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	wss "golang.org/x/net/websocket"
+)
+
+func newEchoServer() *httptest.Server {
+	return httptest.NewServer(wss.Handler(func(ws *wss.Conn) {
+		for {
+			var bs []byte
+			if err := wss.Message.Receive(ws, &bs); err != nil {
+				return
+			}
+			if err := wss.Message.Send(ws, bs); err != nil {
+				return
+			}
+		}
+	}))
+}
+
+func wsUrl(srv *httptest.Server) string {
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+func TestDispatchSequential(t *testing.T) {
+	srv := newEchoServer()
+	defer srv.Close()
+	const n = 500
+	var mux sync.Mutex
+	var got []int
+	done := make(chan struct{})
+	wh, err := NewHandler(&Config{
+		Url:      wsUrl(srv),
+		Origin:   srv.URL,
+		Dispatch: DispatchSequential,
+		OnMessage: func(c *Handler, msg []byte) {
+			i, _ := strconv.Atoi(string(msg))
+			mux.Lock()
+			defer mux.Unlock()
+			if got = append(got, i); len(got) == n {
+				close(done)
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wh.Close()
+	for i := 0; i < n; i++ {
+		if err := wh.Send([]byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	for i, v := range got {
+		if i != v {
+			t.Fatalf("out of order at %d: %d", i, v)
+		}
+	}
+}
+
+func TestDispatchKeyed(t *testing.T) {
+	srv := newEchoServer()
+	defer srv.Close()
+	const n = 600
+	var mux sync.Mutex
+	got := map[string][]int{}
+	var count int
+	done := make(chan struct{})
+	wh, err := NewHandler(&Config{
+		Url:          wsUrl(srv),
+		Origin:       srv.URL,
+		Dispatch:     DispatchKeyed,
+		Partitions:   4,
+		PartitionKey: func(msg []byte) string { return string(msg[:1]) },
+		OnMessage: func(c *Handler, msg []byte) {
+			i, _ := strconv.Atoi(string(msg[2:]))
+			mux.Lock()
+			defer mux.Unlock()
+			got[string(msg[:1])] = append(got[string(msg[:1])], i)
+			if count++; count == n {
+				close(done)
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wh.Close()
+	keys := []string{"a", "b", "c"}
+	for i := 0; i < n; i++ {
+		if err := wh.Send([]byte(keys[i%3] + ":" + strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	for k, vs := range got {
+		for i := 1; i < len(vs); i++ {
+			if vs[i] <= vs[i-1] {
+				t.Fatalf("key %s out of order: %v", k, vs)
+			}
+		}
+	}
+}
+
+func TestDispatchKeyedRequiresKey(t *testing.T) {
+	if _, err := NewHandler(&Config{Url: "ws://127.0.0.1:1", Dispatch: DispatchKeyed}); err == nil {
+		t.Fatal("expected an error without PartitionKey")
+	}
+}
+
+func TestDispatchPoolOverflowClose(t *testing.T) {
+	srv := newEchoServer()
+	defer srv.Close()
+	block := make(chan struct{})
+	closed := make(chan struct{})
+	wh, err := NewHandler(&Config{
+		Url:       wsUrl(srv),
+		Origin:    srv.URL,
+		Dispatch:  DispatchPool,
+		Workers:   1,
+		QueueSize: 1,
+		Overflow:  OverflowClose,
+		OnMessage: func(c *Handler, msg []byte) { <-block },
+		OnClose:   func(c *Handler) { close(closed) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		wh.Send([]byte("x"))
+	}
+	time.Sleep(200 * time.Millisecond)
+	if wh.Error() != ErrQueueOverflow {
+		t.Fatalf("expected overflow, got %v", wh.Error())
+	}
+	close(block)
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnClose not called")
+	}
+}
+
+func TestDialHeaderAndProtocol(t *testing.T) {
+	var auth string
+	srv := httptest.NewServer(wss.Server{
+		Handshake: func(c *wss.Config, r *http.Request) error {
+			auth = r.Header.Get("Authorization")
+			c.Protocol = []string{"v2.gofer"}
+			return nil
+		},
+		Handler: func(ws *wss.Conn) { wss.Message.Receive(ws, new([]byte)) },
+	})
+	defer srv.Close()
+	wh, err := NewHandler(&Config{
+		Url:       wsUrl(srv),
+		Origin:    srv.URL,
+		Header:    http.Header{"Authorization": {"Bearer token"}},
+		Protocols: []string{"v1.gofer", "v2.gofer"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wh.Close()
+	if auth != "Bearer token" {
+		t.Fatalf("Authorization header not sent: %q", auth)
+	}
+	if p := wh.Protocol(); p != "v2.gofer" {
+		t.Fatalf("unexpected protocol %q", p)
+	}
+}
+
+func TestDialHandshakeTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+	start := time.Now()
+	_, err = NewHandler(&Config{Url: "wss://" + ln.Addr().String(), Origin: "https://localhost", TimeOut: 200 * time.Millisecond})
+	if err == nil || time.Since(start) > 5*time.Second {
+		t.Fatalf("expected a timeout, got %v after %v", err, time.Since(start))
+	}
+	_, err = NewHandler(&Config{Url: "ws://localhost", Origin: "http://localhost", Proxy: "http://" + ln.Addr().String(), TimeOut: 200 * time.Millisecond})
+	if err == nil || time.Since(start) > 10*time.Second {
+		t.Fatalf("expected a timeout, got %v after %v", err, time.Since(start))
+	}
+}
+
+func TestDialHttpProxy(t *testing.T) {
+	srv := newEchoServer()
+	defer srv.Close()
+	var connected string
+	proxySrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		connected = r.Host
+		dst, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		src, _, _ := w.(http.Hijacker).Hijack()
+		src.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go func() {
+			defer dst.Close()
+			io.Copy(dst, src)
+		}()
+		go func() {
+			defer src.Close()
+			io.Copy(src, dst)
+		}()
+	}))
+	defer proxySrv.Close()
+	got := make(chan []byte, 1)
+	wh, err := NewHandler(&Config{
+		Url:       wsUrl(srv),
+		Origin:    srv.URL,
+		Proxy:     proxySrv.URL,
+		OnMessage: func(c *Handler, msg []byte) { got <- msg },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wh.Close()
+	if connected != strings.TrimPrefix(srv.URL, "http://") {
+		t.Fatalf("proxy not used: %q", connected)
+	}
+	wh.Send([]byte("hello"))
+	select {
+	case msg := <-got:
+		if string(msg) != "hello" {
+			t.Fatalf("unexpected message %q", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+}
+
+// newNativeServer starts a server on the frame layer of this package, ext is the extension response
+func newNativeServer(t *testing.T, offers chan<- string, ext string, handle func(c *wsConn)) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if offers != nil {
+			offers <- r.Header.Get("Sec-WebSocket-Extensions")
+		}
+		rwc, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer rwc.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+		brw.WriteString("Sec-WebSocket-Accept: " + acceptKey(r.Header.Get("Sec-WebSocket-Key")) + "\r\n")
+		if ext != "" {
+			brw.WriteString("Sec-WebSocket-Extensions: " + ext + "\r\n")
+		}
+		brw.WriteString("\r\n")
+		brw.Flush()
+		c := newConn(rwc, brw.Reader, false)
+		if ext != "" {
+			c.deflate = &deflater{level: 1, writeTakeover: true, readTakeover: true}
+		}
+		handle(c)
+	}))
+}
+
+func nativeEcho(c *wsConn) {
+	for {
+		op, msg, err := c.readMessage()
+		if err != nil {
+			return
+		}
+		if err = c.writeMessage(context.Background(), op, msg); err != nil {
+			return
+		}
+	}
+}
+
+func TestPermessageDeflate(t *testing.T) {
+	ext := make(chan string, 1)
+	srv := newNativeServer(t, ext, "permessage-deflate", nativeEcho)
+	defer srv.Close()
+	got := make(chan []byte, 16)
+	wh, err := NewHandler(&Config{
+		Url:                  wsUrl(srv),
+		Origin:               srv.URL,
+		Compression:          true,
+		CompressionThreshold: 16,
+		Dispatch:             DispatchSequential,
+		OnMessage:            func(c *Handler, msg []byte) { got <- msg },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wh.Close()
+	if e := <-ext; e != "permessage-deflate" {
+		t.Fatalf("unexpected offer %q", e)
+	}
+	if !wh.Compressed() {
+		t.Fatal("deflate not negotiated")
+	}
+	msgs := []string{"short", strings.Repeat(`{"metric":"cpu","value":0.5}`, 100), strings.Repeat(`{"metric":"cpu","value":0.5}`, 200)}
+	for _, m := range msgs {
+		if err := wh.Send([]byte(m)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, m := range msgs {
+		select {
+		case msg := <-got:
+			if string(msg) != m {
+				t.Fatalf("unexpected message %q", msg)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout")
+		}
+	}
+}
+
+func TestDeflateKnownAnswer(t *testing.T) {
+	srv := newNativeServer(t, nil, "permessage-deflate", func(c *wsConn) {
+		// the compressed "Hello" of RFC 7692 7.2.3.1
+		c.rwc.Write([]byte{0xc1, 0x07, 0xf2, 0x48, 0xcd, 0xc9, 0xc9, 0x07, 0x00})
+		c.readMessage()
+	})
+	defer srv.Close()
+	got := make(chan []byte, 1)
+	wh, err := NewHandler(&Config{
+		Url:         wsUrl(srv),
+		Origin:      srv.URL,
+		Compression: true,
+		OnMessage:   func(c *Handler, msg []byte) { got <- msg },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wh.Close()
+	select {
+	case msg := <-got:
+		if string(msg) != "Hello" {
+			t.Fatalf("unexpected message %q", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+}
+
+func TestProtocolError(t *testing.T) {
+	frames := map[string][]byte{
+		"masked":       {0x81, 0x85, 1, 2, 3, 4, 'H' ^ 1, 'e' ^ 2, 'l' ^ 3, 'l' ^ 4, 'o' ^ 1},
+		"rsv1 ping":    {0xc9, 0x00},
+		"rsv1 continu": {0x01, 0x01, 'a', 0xc0, 0x01, 'b'},
+	}
+	for name, frame := range frames {
+		peer := make(chan error, 1)
+		srv := newNativeServer(t, nil, "permessage-deflate", func(c *wsConn) {
+			c.rwc.Write(frame)
+			_, _, err := c.readMessage()
+			peer <- err
+		})
+		wh, err := NewHandler(&Config{Url: wsUrl(srv), Origin: srv.URL, Compression: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case err = <-peer:
+			if ce, ok := err.(*CloseError); !ok || ce.Code != CloseProtocolError {
+				t.Fatalf("%s: peer received %v", name, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: timeout", name)
+		}
+		wh.Close()
+		srv.Close()
+	}
+}
+
+func TestAppCompress(t *testing.T) {
+	for _, c := range []AppCompress{AppCompressZstd, AppCompressSnappy} {
+		msg := []byte(strings.Repeat("telemetry", 64))
+		bs, err := appEncode(c, 16, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if AppCompress(bs[0]) != c || len(bs) >= len(msg) {
+			t.Fatalf("message not compressed with %d", c)
+		}
+		if bs, err = appDecode(bs); err != nil || string(bs) != string(msg) {
+			t.Fatal("decode failed", err)
+		}
+	}
+	if bs, _ := appEncode(AppCompressZstd, 16, []byte("tiny")); bs[0] != byte(AppCompressNone) {
+		t.Fatal("message below threshold should not be compressed")
+	}
+}
+
+func TestStatsAndState(t *testing.T) {
+	srv := newEchoServer()
+	defer srv.Close()
+	var mux sync.Mutex
+	var states []State
+	got := make(chan []byte, 4)
+	wh, err := NewHandler(&Config{
+		Url:       wsUrl(srv),
+		Origin:    srv.URL,
+		OnMessage: func(c *Handler, msg []byte) { got <- msg },
+		OnStateChange: func(c *Handler, old, new State) {
+			mux.Lock()
+			defer mux.Unlock()
+			states = append(states, new)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wh.State() != StateOpen {
+		t.Fatalf("unexpected state %s", wh.State())
+	}
+	wh.Send([]byte("hello"))
+	<-got
+	if err = wh.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100 && wh.Stats().RTT == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	st := wh.Stats()
+	if st.MessagesSent != 1 || st.MessagesReceived != 1 || st.BytesSent != 5 || st.BytesReceived != 5 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+	if st.RTT <= 0 || st.LastReceived.IsZero() {
+		t.Fatalf("rtt or last message time not recorded %+v", st)
+	}
+	if err = wh.Reconnect(); err != nil {
+		t.Fatal(err)
+	}
+	if st = wh.Stats(); st.Reconnects != 1 || st.State != StateOpen {
+		t.Fatalf("unexpected stats after reconnect %+v", st)
+	}
+	wh.Send([]byte("again"))
+	<-got
+	wh.Close()
+	for i := 0; i < 100 && wh.State() != StateClosed; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	mux.Lock()
+	defer mux.Unlock()
+	want := []State{StateConnecting, StateOpen, StateClosing, StateClosed, StateConnecting, StateOpen, StateClosing, StateClosed}
+	if fmt.Sprint(states) != fmt.Sprint(want) {
+		t.Fatalf("unexpected state changes %v", states)
+	}
+}
+
+func TestReconnectFromOnClose(t *testing.T) {
+	srv := newEchoServer()
+	defer srv.Close()
+	var once sync.Once
+	reconnected := make(chan error, 1)
+	got := make(chan []byte, 1)
+	wh, err := NewHandler(&Config{
+		Url:       wsUrl(srv),
+		Origin:    srv.URL,
+		OnMessage: func(c *Handler, msg []byte) { got <- msg },
+		OnClose:   func(c *Handler) { once.Do(func() { reconnected <- c.Reconnect() }) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wh.Close()
+	wh.Close()
+	select {
+	case err = <-reconnected:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Reconnect from OnClose hangs")
+	}
+	if err = wh.Send([]byte("again")); err != nil {
+		t.Fatal(err)
+	}
+	if msg := <-got; string(msg) != "again" {
+		t.Fatalf("unexpected message %q", msg)
+	}
+}
+
+func TestReconnectFromOnMessage(t *testing.T) {
+	for _, mode := range []DispatchMode{DispatchSequential, DispatchPool, DispatchKeyed} {
+		srv := newEchoServer()
+		reconnected := make(chan error, 1)
+		got := make(chan []byte, 1)
+		wh, err := NewHandler(&Config{
+			Url:          wsUrl(srv),
+			Origin:       srv.URL,
+			Dispatch:     mode,
+			PartitionKey: func(msg []byte) string { return "" },
+			OnMessage: func(c *Handler, msg []byte) {
+				if string(msg) == "reconnect" {
+					reconnected <- c.Reconnect()
+					return
+				}
+				got <- msg
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		wh.Send([]byte("reconnect"))
+		select {
+		case err = <-reconnected:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("mode %d: Reconnect from OnMessage hangs", mode)
+		}
+		if err = wh.Send([]byte("again")); err != nil {
+			t.Fatal(err)
+		}
+		if msg := <-got; string(msg) != "again" {
+			t.Fatalf("mode %d: unexpected message %q", mode, msg)
+		}
+		wh.Close()
+		srv.Close()
+	}
+}
+
+func TestCloseWithCode(t *testing.T) {
+	peer := make(chan *CloseError, 1)
+	srv := newNativeServer(t, nil, "", func(c *wsConn) {
+		_, _, err := c.readMessage()
+		peer <- err.(*CloseError)
+	})
+	defer srv.Close()
+	type closed struct {
+		code   int
+		reason string
+	}
+	onClose := make(chan closed, 1)
+	wh, err := NewHandler(&Config{
+		Url:     wsUrl(srv),
+		Origin:  srv.URL,
+		OnClose: func(c *Handler) { onClose <- closed{c.CloseCode(), c.CloseReason()} },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = wh.CloseWithCode(CloseGoingAway, "shutdown"); err != nil {
+		t.Fatal(err)
+	}
+	if ce := <-peer; ce.Code != CloseGoingAway || ce.Reason != "shutdown" {
+		t.Fatalf("peer received %+v", ce)
+	}
+	if c := <-onClose; c.code != CloseGoingAway {
+		t.Fatalf("unexpected echo %+v", c)
+	}
+	if err = wh.Send([]byte("x")); err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestPeerClose(t *testing.T) {
+	srv := newNativeServer(t, nil, "", func(c *wsConn) {
+		c.writeClose(4000, "bye", time.Now().Add(time.Second))
+		c.readMessage()
+	})
+	defer srv.Close()
+	onClose := make(chan string, 1)
+	_, err := NewHandler(&Config{
+		Url:     wsUrl(srv),
+		Origin:  srv.URL,
+		OnClose: func(c *Handler) { onClose <- fmt.Sprint(c.CloseCode(), c.CloseReason()) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case s := <-onClose:
+		if s != "4000bye" {
+			t.Fatalf("unexpected close %q", s)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+}
+
+func TestSendContextDeadline(t *testing.T) {
+	block := make(chan struct{})
+	srv := newNativeServer(t, nil, "", func(c *wsConn) { <-block })
+	defer srv.Close()
+	defer close(block)
+	wh, err := NewHandler(&Config{Url: wsUrl(srv), Origin: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	big := make([]byte, 1<<20)
+	for err == nil {
+		err = wh.SendContext(ctx, big)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+}